@@ -0,0 +1,319 @@
+package main
+
+import (
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamPool is the set of upstream instances that requests can be
+// sent to, when the backend is given as more than one URL.  Requests
+// are spread across the instances that are up, by round-robin, least
+// (active) connections, or a sticky cookie that gotcha hands out.
+//
+// Instances are taken out of rotation when they fail an active health
+// check (a GET of some path, every so often), and when they fail too
+// many requests in a row (connection errors, or a 502, 503 or 504),
+// until the ejection runs out.  If every instance is out, requests go
+// to all of them anyway, since there's nothing better to do.
+type upstreamPool struct {
+	lock      sync.Mutex
+	instances []*upstreamInstance
+	next      int
+
+	balance string
+	cookie  string
+
+	ejectAfter int
+	ejectFor   time.Duration
+
+	healthPath     string
+	healthInterval time.Duration
+}
+
+type upstreamInstance struct {
+	id  int
+	url *url.URL
+
+	active       int
+	failures     int
+	unhealthy    bool
+	ejectedUntil time.Time
+}
+
+func (i *upstreamInstance) String() string {
+	return fmt.Sprintf("#%d %s://%s", i.id, i.url.Scheme, i.url.Host)
+}
+
+func (i *upstreamInstance) available(now time.Time) bool {
+	return !i.unhealthy && !now.Before(i.ejectedUntil)
+}
+
+func parseUpstreamPool(backend string, opt *Opt) (*upstreamPool, error) {
+	p := &upstreamPool{
+		balance:    opt.Balance,
+		cookie:     opt.StickyCookie,
+		ejectAfter: opt.EjectAfter,
+		healthPath: opt.HealthCheck,
+	}
+
+	switch p.balance {
+	case "":
+		p.balance = "round-robin"
+	case "round-robin", "least-conns", "sticky":
+	default:
+		return nil, fmt.Errorf("invalid --balance '%s' (should be round-robin, least-conns or sticky)", p.balance)
+	}
+	if p.healthPath != "" && !strings.HasPrefix(p.healthPath, "/") {
+		p.healthPath = "/" + p.healthPath
+	}
+
+	err := parseDurations([]durationOption{
+		{"--eject-for", opt.EjectFor, &p.ejectFor},
+		{"--health-interval", opt.HealthInterval, &p.healthInterval},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	/* not splitList: URLs can have commas in them */
+	for _, s := range strings.Fields(backend) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse target '%s': %s", s, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("failed to parse target '%s': should be a URL, like https://host:port", s)
+		}
+		p.instances = append(p.instances, &upstreamInstance{id: len(p.instances) + 1, url: u})
+	}
+	if len(p.instances) == 0 {
+		return nil, fmt.Errorf("failed to parse target '%s': no URLs found", backend)
+	}
+	return p, nil
+}
+
+// Len is how many instances there are; dumps only bother saying which
+// one was picked if there's more than one.
+func (p *upstreamPool) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.instances)
+}
+
+// Pick chooses the instance to send req to, and says why.  The caller
+// must Release the instance when it is done with it.  Instances that
+// req has already been tried on (and failed) are left out, if there's
+// anywhere else to go, and so is the sticky cookie, which names one.
+func (p *upstreamPool) Pick(req *http.Request, tried []*upstreamInstance) (*upstreamInstance, string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	var up, untried []*upstreamInstance
+	for _, i := range p.instances {
+		if i.available(now) {
+			up = append(up, i)
+			if !containsInstance(tried, i) {
+				untried = append(untried, i)
+			}
+		}
+	}
+	note := ""
+	if len(untried) > 0 {
+		up = untried
+	} else if len(up) > 0 && len(tried) > 0 {
+		note = ", though it has been tried already"
+	}
+	if len(up) == 0 {
+		up, note = p.instances, ", though every instance is down"
+	}
+
+	var pick *upstreamInstance
+	why := p.balance
+	if p.balance == "sticky" && len(tried) > 0 {
+		why = "retrying, so not by sticky cookie; round-robin"
+	} else if p.balance == "sticky" {
+		if c, err := req.Cookie(p.cookie); err == nil {
+			id, _ := strconv.Atoi(c.Value)
+			for _, i := range up {
+				if i.id == id {
+					pick, why = i, "sticky cookie"
+				}
+			}
+			if pick == nil {
+				why = fmt.Sprintf("sticky cookie named #%s, which is down; round-robin", c.Value)
+			}
+		} else {
+			why = "no sticky cookie yet; round-robin"
+		}
+	}
+
+	if pick == nil && p.balance == "least-conns" {
+		for _, i := range up {
+			if pick == nil || i.active < pick.active {
+				pick = i
+			}
+		}
+		why = fmt.Sprintf("least connections (%d active)", pick.active)
+	}
+
+	if pick == nil {
+		for n := 0; n < len(p.instances) && pick == nil; n++ {
+			i := p.instances[(p.next+n)%len(p.instances)]
+			for _, u := range up {
+				if u == i {
+					pick = i
+				}
+			}
+		}
+		p.next = pick.id % len(p.instances)
+	}
+
+	pick.active++
+	return pick, why + note
+}
+
+func containsInstance(l []*upstreamInstance, i *upstreamInstance) bool {
+	for _, x := range l {
+		if x == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Release says that a request sent to i is over.
+func (p *upstreamPool) Release(i *upstreamInstance) {
+	if p == nil || i == nil {
+		return
+	}
+	p.lock.Lock()
+	i.active--
+	p.lock.Unlock()
+}
+
+// Report counts the outcome of a request sent to i towards ejecting it
+// (or not).
+func (p *upstreamPool) Report(i *upstreamInstance, err error, res *http.Response) {
+	if p == nil || i == nil {
+		return
+	}
+	problem := ""
+	if err != nil {
+		problem = err.Error()
+	} else if res.StatusCode == 502 || res.StatusCode == 503 || res.StatusCode == 504 {
+		problem = res.Status
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if problem == "" {
+		i.failures = 0
+		return
+	}
+	i.failures++
+	if p.ejectAfter > 0 && i.failures >= p.ejectAfter && len(p.instances) > 1 {
+		fmt.Fprintf(os.Stderr, "@R{ejecting instance %s} for %s, after %d failures in a row (last: %s)\n", i, p.ejectFor, i.failures, problem)
+		i.ejectedUntil = time.Now().Add(p.ejectFor)
+		i.failures = 0
+	}
+}
+
+// Stick hands the client a cookie naming the instance that served it,
+// if it doesn't have one already, so that it comes back to it.
+func (p *upstreamPool) Stick(h http.Header, req *http.Request, i *upstreamInstance) {
+	if p == nil || i == nil || p.balance != "sticky" {
+		return
+	}
+	if c, err := req.Cookie(p.cookie); err == nil && c.Value == strconv.Itoa(i.id) {
+		return
+	}
+	h.Add("Set-Cookie", (&http.Cookie{Name: p.cookie, Value: strconv.Itoa(i.id), Path: "/", HttpOnly: true}).String())
+}
+
+// Unstick takes gotcha's sticky cookie out of a request bound for the
+// upstream, which has no use for it.
+func (p *upstreamPool) Unstick(req *http.Request) {
+	if p == nil || p.balance != "sticky" {
+		return
+	}
+	var keep []string
+	for _, c := range req.Cookies() {
+		if c.Name != p.cookie {
+			keep = append(keep, c.String())
+		}
+	}
+	req.Header.Del("Cookie")
+	if len(keep) > 0 {
+		req.Header.Set("Cookie", strings.Join(keep, "; "))
+	}
+}
+
+// Dump says which instance a request went to, and why.
+func (p *upstreamPool) Dump(out io.Writer, i *upstreamInstance, why string) {
+	if p.Len() < 2 {
+		return
+	}
+	fmt.Fprintf(out, "@C{upstream instance:} @Y{%s} (%s)\n\n", i, why)
+}
+
+// HealthCheck checks every instance, every --health-interval, for as
+// long as gotcha runs, and says so when one goes down or comes back.
+func (p *upstreamPool) HealthCheck(transport http.RoundTripper) {
+	if p == nil || p.healthPath == "" {
+		return
+	}
+	interval := p.healthInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   interval,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for {
+		for _, i := range p.instances {
+			problem := ""
+			u := *i.url
+			u.Path, u.RawQuery = p.healthPath, ""
+			req, err := http.NewRequest("GET", u.String(), nil)
+			if err != nil {
+				continue
+			}
+			req = req.WithContext(withUpstreamHost(req.Context(), u.Hostname()))
+			res, err := client.Do(req)
+			if err != nil {
+				problem = err.Error()
+			} else {
+				io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+				if res.StatusCode >= 400 {
+					problem = res.Status
+				}
+			}
+
+			p.lock.Lock()
+			if problem != "" && !i.unhealthy {
+				fmt.Fprintf(os.Stderr, "@R{instance %s failed its health check:} %s\n", i, problem)
+			} else if problem == "" && i.unhealthy {
+				fmt.Fprintf(os.Stderr, "@G{instance %s passed its health check}\n", i)
+			}
+			i.unhealthy = problem != ""
+			p.lock.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, balance string, n int) *upstreamPool {
+	var urls []string
+	for i := 1; i <= n; i++ {
+		urls = append(urls, fmt.Sprintf("http://10.0.0.%d:8080", i))
+	}
+	p, err := parseUpstreamPool(strings.Join(urls, " "), &Opt{
+		Balance:        balance,
+		StickyCookie:   "gotcha-instance",
+		EjectAfter:     3,
+		EjectFor:       "30s",
+		HealthInterval: "10s",
+	})
+	if err != nil {
+		t.Fatalf("failed to set up pool: %s", err)
+	}
+	return p
+}
+
+func TestParseUpstreamPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		balance string
+		want    []string
+	}{
+		{"one URL", "https://api.example.com", "", []string{"https://api.example.com"}},
+		{"several URLs", "http://10.0.0.1:8080 http://10.0.0.2:8080", "", []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}},
+		{"any whitespace", "  http://10.0.0.1:8080\n\thttp://10.0.0.2:8080 ", "", []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}},
+		{"a comma in the path", "http://10.0.0.1:8080/a,b", "", []string{"http://10.0.0.1:8080/a,b"}},
+		{"a comma in the query", "http://10.0.0.1:8080/?ids=1,2,3", "", []string{"http://10.0.0.1:8080/?ids=1,2,3"}},
+		{"least-conns", "http://10.0.0.1:8080", "least-conns", []string{"http://10.0.0.1:8080"}},
+		{"sticky", "http://10.0.0.1:8080", "sticky", []string{"http://10.0.0.1:8080"}},
+		{"nothing", "   ", "", nil},
+		{"not a URL", "http://10.0.0.1:8080 10.0.0.2", "", nil},
+		{"no scheme", "//10.0.0.1:8080", "", nil},
+		{"no host", "http:///path", "", nil},
+		{"an unknown strategy", "http://10.0.0.1:8080", "random", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := parseUpstreamPool(test.backend, &Opt{Balance: test.balance, EjectFor: "30s", HealthInterval: "10s"})
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("parsed '%s', which should have failed", test.backend)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse '%s': %s", test.backend, err)
+			}
+			var got []string
+			for _, i := range p.instances {
+				got = append(got, i.url.String())
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("got instances %v, not %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolPick(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance string
+		down    []int       // instances that are ejected
+		active  map[int]int // requests already in flight, by instance
+		cookie  string      // the sticky cookie the client sent
+		tried   []int       // instances already tried
+		want    []int       // the instances picked, one request after another
+		why     string      // what the last pick says about itself
+	}{
+		{name: "round-robin", balance: "round-robin", want: []int{1, 2, 3, 1, 2}, why: "round-robin"},
+		{name: "round-robin skips instances that are down", balance: "round-robin", down: []int{2}, want: []int{1, 3, 1, 3}},
+		{name: "every instance down", balance: "round-robin", down: []int{1, 2, 3}, want: []int{1, 2, 3}, why: "though every instance is down"},
+		{name: "least connections", balance: "least-conns", active: map[int]int{1: 2, 2: 0, 3: 1}, want: []int{2, 2, 3}},
+		{name: "least connections skips instances that are down", balance: "least-conns", active: map[int]int{1: 2, 3: 1}, down: []int{2}, want: []int{3}},
+		{name: "sticky cookie", balance: "sticky", cookie: "3", want: []int{3, 3, 3}, why: "sticky cookie"},
+		{name: "no sticky cookie", balance: "sticky", want: []int{1, 2}, why: "no sticky cookie yet"},
+		{name: "sticky cookie for an instance that is down", balance: "sticky", cookie: "2", down: []int{2}, want: []int{1, 3}, why: "which is down"},
+		{name: "sticky cookie for no instance", balance: "sticky", cookie: "9", want: []int{1}, why: "which is down"},
+		{name: "retries go somewhere new", balance: "round-robin", tried: []int{1}, want: []int{2, 3, 2}},
+		{name: "retries ignore the sticky cookie", balance: "sticky", cookie: "1", tried: []int{1}, want: []int{2, 3}, why: "not by sticky cookie"},
+		{name: "retries go back if there's nowhere new", balance: "round-robin", tried: []int{1, 2, 3}, want: []int{1, 2}, why: "tried already"},
+		{name: "retries skip instances that are down", balance: "round-robin", tried: []int{1}, down: []int{3}, want: []int{2, 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPool(t, test.balance, 3)
+			for _, id := range test.down {
+				p.instances[id-1].ejectedUntil = time.Now().Add(time.Minute)
+			}
+			for id, n := range test.active {
+				p.instances[id-1].active = n
+			}
+			var tried []*upstreamInstance
+			for _, id := range test.tried {
+				tried = append(tried, p.instances[id-1])
+			}
+			req, _ := http.NewRequest("GET", "http://gotcha.test/", nil)
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "gotcha-instance", Value: test.cookie})
+			}
+
+			var got []int
+			why := ""
+			for range test.want {
+				var i *upstreamInstance
+				i, why = p.Pick(req, tried)
+				got = append(got, i.id)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("picked %v, not %v", got, test.want)
+			}
+			if !strings.Contains(why, test.why) {
+				t.Errorf("picked because '%s', which doesn't say '%s'", why, test.why)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolReport(t *testing.T) {
+	failed := errors.New("connection refused")
+	tests := []struct {
+		name      string
+		instances int
+		outcomes  []interface{} // an error, or a status code
+		ejected   bool
+	}{
+		{"one failure", 2, []interface{}{failed}, false},
+		{"as many failures as --eject-after", 2, []interface{}{failed, failed, failed}, true},
+		{"502, 503 and 504 are failures", 2, []interface{}{502, 503, 504}, true},
+		{"other errors aren't", 2, []interface{}{500, 404, 500, 429}, false},
+		{"a success starts the count again", 2, []interface{}{failed, failed, 200, failed, failed}, false},
+		{"the only instance is never ejected", 1, []interface{}{failed, failed, failed, failed}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPool(t, "round-robin", test.instances)
+			i := p.instances[0]
+			for _, outcome := range test.outcomes {
+				switch o := outcome.(type) {
+				case error:
+					p.Report(i, o, nil)
+				case int:
+					p.Report(i, nil, &http.Response{StatusCode: o, Status: http.StatusText(o)})
+				}
+			}
+			if ejected := !i.available(time.Now()); ejected != test.ejected {
+				t.Errorf("instance ejected is %v, not %v", ejected, test.ejected)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolEjectionRunsOut(t *testing.T) {
+	p := newTestPool(t, "round-robin", 2)
+	p.ejectFor = 0
+	i := p.instances[0]
+	for n := 0; n < p.ejectAfter; n++ {
+		p.Report(i, errors.New("connection refused"), nil)
+	}
+	if !i.available(time.Now()) {
+		t.Errorf("instance is still out, after its ejection ran out")
+	}
+}
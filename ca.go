@@ -0,0 +1,635 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+type Cert struct {
+	RawCertificate *x509.Certificate
+	RawKey         crypto.Signer
+
+	Certificate string
+	Key         string
+}
+
+func (ca *Cert) Sign(cert *Cert, scheme string) error {
+	alg, err := signatureAlgorithm(ca.RawKey.Public(), scheme)
+	if err != nil {
+		return err
+	}
+	cert.RawCertificate.SignatureAlgorithm = alg
+
+	raw, err := x509.CreateCertificate(rand.Reader, cert.RawCertificate, ca.RawCertificate, cert.RawKey.Public(), ca.RawKey)
+	if err != nil {
+		return err
+	}
+
+	signed, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return err
+	}
+
+	cert.RawCertificate = signed
+	cert.Certificate = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: raw,
+	}))
+
+	return nil
+}
+
+// caCertificate generates a certificate authority (to be self-signed)
+// that can only be used to sign end-entity certificates.
+func caCertificate(name string, ttl time.Duration, keyType string) (*Cert, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	return certificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		SerialNumber:          serial,
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(ttl),
+	}, keyType)
+}
+
+// leafCertificate generates an end-entity certificate that TLS servers
+// can present.  The first name becomes the subject common name, and all
+// of them (DNS names and IP addresses alike) go into the SANs.
+func leafCertificate(names []string, ttl time.Duration, keyType string) (*Cert, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no subject alternative names given for certificate")
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: names[0]},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		SerialNumber:          serial,
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(ttl),
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			cert.IPAddresses = append(cert.IPAddresses, ip)
+		} else {
+			cert.DNSNames = append(cert.DNSNames, name)
+		}
+	}
+
+	return certificate(cert, keyType)
+}
+
+func certificate(cert *x509.Certificate, keyType string) (*Cert, error) {
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := key.Public().(*rsa.PublicKey); ok && !cert.IsCA {
+		/* RSA key exchange (TLS 1.2 and older) encrypts with the key */
+		cert.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	cert.SubjectKeyId, err = subjectKeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	pKey, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cert{
+		RawCertificate: cert,
+		RawKey:         key,
+
+		Key: pKey,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// subjectKeyID derives a key identifier from the public key, per the
+// first method in RFC 5280 section 4.2.1.2.  crypto/x509 copies the
+// issuer's into the authority key identifier of everything it signs.
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+// bindNames works out what names clients might use to reach a listener
+// bound to the given address, for putting in its certificate.  If it
+// is bound to all interfaces, that's localhost, the hostname, and all
+// of the addresses of all of the interfaces.
+func bindNames(bind string) []string {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		host = bind
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{host}
+	}
+
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	names = append(names, "127.0.0.1", "::1")
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			names = append(names, ipnet.IP.String())
+		}
+	}
+	return names
+}
+
+var ErrNoCA = errors.New("no gotcha CA found")
+
+// Where the CA lives, and the passphrase (if any) that its private key
+// is encrypted with; main() sets these from the command-line options
+// and the environment.
+var (
+	CADir        string
+	CAPassphrase string
+)
+
+func caDir() string {
+	if CADir != "" {
+		return CADir
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return home + "/.gotcha"
+	}
+	return ""
+}
+
+func caCertPath() string {
+	return filepath.Join(caDir(), "ca_cert.pem")
+}
+
+func caKeyPath() string {
+	return filepath.Join(caDir(), "ca_key.pem")
+}
+
+// leafCacheDir is where certificates issued for --tls are cached.
+func leafCacheDir() string {
+	return filepath.Join(caDir(), "leaves")
+}
+
+func writeFile(path string, b []byte, mode os.FileMode) error {
+	if err := ioutil.WriteFile(path, b, mode); err != nil {
+		return err
+	}
+	/* WriteFile leaves the mode of existing files alone */
+	return os.Chmod(path, mode)
+}
+
+func newCA(keyType, scheme string) (*Cert, error) {
+	ca, err := caCertificate("gotcha-ca", 100*365*24*time.Hour, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a CA certificate: %s", err)
+	}
+
+	if err := ca.Sign(ca, scheme); err != nil {
+		return nil, fmt.Errorf("failed to sign CA certificate: %s", err)
+	}
+	return ca, nil
+}
+
+// installCA writes ca to the CA directory, in place of whatever is
+// there.  The new certificate and key are written next to the old ones
+// first, and renamed into place, so that nothing is lost if writing
+// them fails.  With backup, the old ones are kept as *.old (moving any
+// earlier backup along to *.old.1, *.old.2, and so on), and are put
+// back if the new ones can't be.
+func installCA(ca *Cert, backup bool) error {
+	if caDir() == "" {
+		return errors.New("nowhere to put the gotcha CA; set $GOTCHA_CA_DIR (or use --ca-dir)")
+	}
+
+	key := ca.Key
+	if CAPassphrase != "" {
+		var err error
+		if key, err = encodeEncryptedPrivateKey(ca.RawKey, CAPassphrase); err != nil {
+			return fmt.Errorf("failed to encrypt CA private key: %s", err)
+		}
+	}
+
+	if err := os.MkdirAll(caDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create gotcha CA folder at %s: %s", caDir(), err)
+	}
+
+	files := []struct {
+		path string
+		b    []byte
+		mode os.FileMode
+	}{
+		{caCertPath(), []byte(ca.Certificate), 0644},
+		{caKeyPath(), []byte(key), 0600},
+	}
+
+	/* undo what has been done, last thing first */
+	var written []string
+	var undo [][2]string
+	rollback := func(err error) error {
+		for n := len(undo) - 1; n >= 0; n-- {
+			os.Rename(undo[n][1], undo[n][0])
+		}
+		for _, path := range written {
+			os.Remove(path)
+		}
+		return err
+	}
+	move := func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		undo = append(undo, [2]string{from, to})
+		return nil
+	}
+
+	for _, f := range files {
+		if err := writeFile(f.path+".new", f.b, f.mode); err != nil {
+			return rollback(err)
+		}
+		written = append(written, f.path+".new")
+	}
+
+	if backup {
+		for _, f := range files {
+			old := f.path + ".old"
+			if _, err := os.Stat(old); err == nil {
+				to := nextBackup(old)
+				if err := move(old, to); err != nil {
+					return rollback(fmt.Errorf("failed to move aside %s: %s", old, err))
+				}
+				fmt.Fprintf(os.Stderr, "kept the previous backup @C{%s} as @C{%s}\n", old, to)
+			}
+			if err := move(f.path, old); err != nil {
+				return rollback(fmt.Errorf("failed to back up %s: %s", f.path, err))
+			}
+		}
+	}
+	for _, f := range files {
+		if err := move(f.path+".new", f.path); err != nil {
+			return rollback(fmt.Errorf("failed to install %s: %s", f.path, err))
+		}
+	}
+	return nil
+}
+
+// nextBackup finds the first of path.1, path.2, ... that isn't taken.
+func nextBackup(path string) string {
+	for n := 1; ; n++ {
+		next := fmt.Sprintf("%s.%d", path, n)
+		if _, err := os.Stat(next); os.IsNotExist(err) {
+			return next
+		}
+	}
+}
+
+func loadCA() (*Cert, error) {
+	if caDir() == "" {
+		return nil, ErrNoCA
+	}
+	cert, err := ioutil.ReadFile(caCertPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoCA
+		}
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(caKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(caKeyPath()); err == nil && info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "@Y{warning:} CA private key %s is readable by others (mode %04o); `chmod 0600` it\n", caKeyPath(), info.Mode().Perm())
+	}
+	certBlock, _ := pem.Decode(cert)
+	if certBlock == nil {
+		return nil, errors.New("Failed to decode ca certificate")
+	}
+	keyBlock, _ := pem.Decode(key)
+	if keyBlock == nil {
+		return nil, errors.New("Failed to decode ca private key")
+	}
+	rawKey, err := parsePrivateKey(keyBlock, CAPassphrase)
+	if err != nil {
+		if keyBlock.Type == "ENCRYPTED PRIVATE KEY" && CAPassphrase == "" {
+			return nil, errors.New("the CA private key is encrypted; set $GOTCHA_CA_PASSPHRASE (or use --ca-passphrase)")
+		}
+		return nil, err
+	}
+	rawCert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pKey := string(key)
+	if keyBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		/* keep the decrypted key around, for exporting */
+		if pKey, err = encodePrivateKey(rawKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Cert{
+		RawCertificate: rawCert,
+		RawKey:         rawKey,
+
+		Certificate: string(cert),
+		Key:         pKey,
+	}, nil
+}
+
+type CAOpt struct {
+	Init struct {
+		Force bool `cli:"-f, --force"`
+	} `cli:"init"`
+
+	Show struct{} `cli:"show"`
+
+	Export struct {
+		Format   string `cli:"-F, --format"`
+		Key      bool   `cli:"--key"`
+		Password string `cli:"-p, --password"`
+		Output   string `cli:"-o, --output"`
+	} `cli:"export"`
+
+	Rotate struct{} `cli:"rotate"`
+
+	Fingerprint struct{} `cli:"fingerprint"`
+
+	Issue struct {
+		Days int    `cli:"-d, --days"`
+		Cert string `cli:"-c, --cert"`
+		Key  string `cli:"--key"`
+	} `cli:"issue"`
+}
+
+func caUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: @G{gotcha} ca @C{COMMAND} [options]\n\n")
+	fmt.Fprintf(out, "Manage the CA that gotcha uses to sign certificates for --tls.\n")
+	fmt.Fprintf(out, "The CA lives in %s (see --ca-dir); if --ca-passphrase is given,\n", caDir())
+	fmt.Fprintf(out, "its private key is encrypted with it.\n\n")
+	fmt.Fprintf(out, "The --key-type and --signature options control the keys and signatures\n")
+	fmt.Fprintf(out, "of newly generated CAs (init, rotate) and certificates (issue).\n\n")
+	fmt.Fprintf(out, "  @C{init}                   Generate a new CA.\n")
+	fmt.Fprintf(out, "    -f, --force          Overwrite the CA, if there is one already.\n\n")
+	fmt.Fprintf(out, "  @C{show}                   Print the details of the CA certificate.\n\n")
+	fmt.Fprintf(out, "  @C{export}                 Print the CA certificate, for importing elsewhere.\n")
+	fmt.Fprintf(out, "    -F, --format FMT     One of 'pem' (the default), 'der' or 'pkcs12'.\n")
+	fmt.Fprintf(out, "        --key            Include the CA private key (pem and pkcs12 only).\n")
+	fmt.Fprintf(out, "    -p, --password PASS  Password to protect a pkcs12 export with.\n")
+	fmt.Fprintf(out, "    -o, --output FILE    Write to FILE, instead of standard output.\n\n")
+	fmt.Fprintf(out, "  @C{rotate}                 Replace the CA with a newly generated one.  The\n")
+	fmt.Fprintf(out, "                         old certificate and key are kept, as *.old\n")
+	fmt.Fprintf(out, "                         (and earlier ones as *.old.1, *.old.2, ...)\n\n")
+	fmt.Fprintf(out, "  @C{fingerprint}            Print the SHA-256 fingerprint of the CA certificate.\n\n")
+	fmt.Fprintf(out, "  @C{issue} @C{HOST...}          Issue a certificate for HOST (and any other hosts,\n")
+	fmt.Fprintf(out, "                         IPs, or --san names given), signed by the CA.\n")
+	fmt.Fprintf(out, "    -d, --days N         How long the certificate is valid for (default 90).\n")
+	fmt.Fprintf(out, "    -c, --cert FILE      Write the certificate to FILE.\n")
+	fmt.Fprintf(out, "        --key FILE       Write the private key to FILE.  Without --cert and\n")
+	fmt.Fprintf(out, "                         --key, both are printed to standard output.\n")
+}
+
+func mustLoadCA() *Cert {
+	ca, err := loadCA()
+	if err == ErrNoCA && caDir() == "" {
+		fmt.Fprintf(os.Stderr, "@R{%s}: $HOME is not set, so there is no default CA directory\n"+
+			"Set $GOTCHA_CA_DIR (or use --ca-dir), or use --ephemeral-ca.\n", err)
+		os.Exit(1)
+	}
+	if err == ErrNoCA {
+		fmt.Fprintf(os.Stderr, "@R{%s} in %s\nRun `gotcha ca init` to generate one, or use --ephemeral-ca.\n", err, caDir())
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "@R{failed to load CA:} %s\n", err)
+		os.Exit(1)
+	}
+	return ca
+}
+
+// mustLoadOrInitCA loads the CA that --tls signs with, generating one
+// (and saving it, if there is a CA directory to keep it in) if there
+// isn't one yet, so that --tls works without anyone getting the chance
+// to run `gotcha ca init` first, as on a `cf push`.  It also returns
+// whether the CA was just generated.
+func mustLoadOrInitCA(keyType, signature string) (*Cert, bool) {
+	ca, err := loadCA()
+	if err == nil {
+		return ca, false
+	}
+	if err != ErrNoCA {
+		fmt.Fprintf(os.Stderr, "@R{failed to load CA:} %s\n", err)
+		os.Exit(1)
+	}
+
+	if ca, err = newCA(keyType, signature); err != nil {
+		fmt.Fprintf(os.Stderr, "@R{%s}\n", err)
+		os.Exit(1)
+	}
+	if caDir() != "" {
+		if err := installCA(ca, false); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{failed to save the new CA:} %s\n", err)
+			os.Exit(1)
+		}
+	}
+	return ca, true
+}
+
+func runCA(opt *Opt, command string, args []string) {
+	switch command {
+	case "ca init":
+		if err := checkKeyOptions(opt.KeyType, opt.Signature); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{%s}\n", err)
+			os.Exit(1)
+		}
+		if _, err := os.Stat(caCertPath()); err == nil && caDir() != "" && !opt.CA.Init.Force {
+			fmt.Fprintf(os.Stderr, "@R{a gotcha CA already exists} in %s\n"+
+				"Use `gotcha ca rotate` to replace it, or `gotcha ca init --force` to overwrite it.\n", caDir())
+			os.Exit(1)
+		}
+		ca, err := newCA(opt.KeyType, opt.Signature)
+		if err == nil {
+			err = installCA(ca, false)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@R{%s}\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("generated a new CA in @C{%s}\n", caDir())
+		fmt.Printf("@C{fingerprint:} %s\n", fingerprint(ca.RawCertificate))
+
+	case "ca show":
+		ca := mustLoadCA()
+		fmt.Printf("@C{certificate:} %s\n", caCertPath())
+		fmt.Printf("@C{private key:} %s\n\n", caKeyPath())
+		dumpCertificate(os.Stdout, 0, ca.RawCertificate)
+		fmt.Printf("\n%s", ca.Certificate)
+
+	case "ca export":
+		ca := mustLoadCA()
+		b, err := exportCA(ca, opt.CA.Export.Format, opt.CA.Export.Key, opt.CA.Export.Password)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@R{failed to export CA:} %s\n", err)
+			os.Exit(1)
+		}
+		if opt.CA.Export.Output == "" {
+			os.Stdout.Write(b)
+			return
+		}
+		mode := os.FileMode(0644)
+		if opt.CA.Export.Key {
+			mode = 0600
+		}
+		if err := writeFile(opt.CA.Export.Output, b, mode); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{failed to export CA:} %s\n", err)
+			os.Exit(1)
+		}
+
+	case "ca rotate":
+		if err := checkKeyOptions(opt.KeyType, opt.Signature); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{%s}\n", err)
+			os.Exit(1)
+		}
+		old := mustLoadCA()
+		ca, err := newCA(opt.KeyType, opt.Signature)
+		if err == nil {
+			err = installCA(ca, true)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@R{%s}\n", err)
+			os.Exit(1)
+		}
+		/* nothing in the cache is signed by the new CA */
+		os.RemoveAll(leafCacheDir())
+		fmt.Printf("rotated the CA in @C{%s}\n", caDir())
+		fmt.Printf("@C{old fingerprint:} %s\n", fingerprint(old.RawCertificate))
+		fmt.Printf("@C{new fingerprint:} %s\n", fingerprint(ca.RawCertificate))
+
+	case "ca fingerprint":
+		ca := mustLoadCA()
+		fmt.Printf("%s\n", fingerprint(ca.RawCertificate))
+
+	case "ca issue":
+		if len(args) == 0 {
+			caUsage(os.Stderr)
+			os.Exit(1)
+		}
+		if opt.CA.Issue.Days <= 0 {
+			fmt.Fprintf(os.Stderr, "@R{--days must be positive}\n")
+			os.Exit(1)
+		}
+		ca := mustLoadCA()
+		names := append(args, splitList(opt.SANs)...)
+		cert, err := leafCertificate(names, time.Duration(opt.CA.Issue.Days)*24*time.Hour, opt.KeyType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@R{failed to generate a certificate:} %s\n", err)
+			os.Exit(1)
+		}
+		if err := ca.Sign(cert, opt.Signature); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{failed to sign certificate:} %s\n", err)
+			os.Exit(1)
+		}
+
+		if opt.CA.Issue.Cert == "" && opt.CA.Issue.Key == "" {
+			fmt.Printf("%s%s", cert.Certificate, cert.Key)
+			return
+		}
+		if opt.CA.Issue.Cert == "" || opt.CA.Issue.Key == "" {
+			fmt.Fprintf(os.Stderr, "@R{--cert and --key must be given together}\n")
+			os.Exit(1)
+		}
+		if err := writeFile(opt.CA.Issue.Cert, []byte(cert.Certificate), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{failed to write certificate:} %s\n", err)
+			os.Exit(1)
+		}
+		if err := writeFile(opt.CA.Issue.Key, []byte(cert.Key), 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{failed to write private key:} %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "issued certificate for @C{%s} (fingerprint %s)\n", strings.Join(names, ", "), fingerprint(cert.RawCertificate))
+
+	default:
+		caUsage(os.Stderr)
+		os.Exit(1)
+	}
+}
+
+func exportCA(ca *Cert, format string, withKey bool, password string) ([]byte, error) {
+	switch format {
+	case "", "pem":
+		if withKey {
+			return []byte(ca.Certificate + ca.Key), nil
+		}
+		return []byte(ca.Certificate), nil
+
+	case "der":
+		if withKey {
+			return nil, fmt.Errorf("der exports only cover the certificate; use pem or pkcs12 to export the key")
+		}
+		return ca.RawCertificate.Raw, nil
+
+	case "pkcs12", "p12":
+		if withKey {
+			return pkcs12.Modern.Encode(ca.RawKey, ca.RawCertificate, nil, password)
+		}
+		return pkcs12.Modern.EncodeTrustStore([]*x509.Certificate{ca.RawCertificate}, password)
+	}
+	return nil, fmt.Errorf("unrecognized export format '%s' (must be one of pem, der, or pkcs12)", format)
+}
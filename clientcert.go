@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// loadClientCertificate reads the certificate (and key) that gotcha
+// presents to upstreams that ask for one.  The certificate file can
+// either be PEM (in which case the key can live in the same file, or
+// in its own), or a PKCS#12 bundle, protected by password.
+func loadClientCertificate(certFile, keyFile, password string) (*tls.Certificate, error) {
+	if certFile == "" {
+		if keyFile != "" {
+			return nil, fmt.Errorf("client key given without a client certificate")
+		}
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyFile == "" && !bytes.Contains(b, []byte("-----BEGIN")) {
+		key, leaf, chain, err := pkcs12.DecodeChain(b, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", certFile, err)
+		}
+
+		cert := &tls.Certificate{
+			Certificate: [][]byte{leaf.Raw},
+			PrivateKey:  key,
+			Leaf:        leaf,
+		}
+		for _, ca := range chain {
+			cert.Certificate = append(cert.Certificate, ca.Raw)
+		}
+		return cert, nil
+	}
+
+	k := b
+	if keyFile != "" {
+		k, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pair, err := tls.X509KeyPair(b, k)
+	if err != nil {
+		return nil, err
+	}
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &pair, nil
+}
+
+// clientCertificates are the certificates gotcha presents to upstreams
+// that ask for one: those given with --client-cert-for, for the hosts
+// they name, and the --client-cert, for every other host.
+type clientCertificates struct {
+	hosts    map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// loadClientCertificates reads the --client-cert, and each of the
+// --client-cert-for HOST=CERT[:KEY] certificates.  PKCS#12 bundles all
+// share the one --client-password.
+func loadClientCertificates(opt *Opt) (*clientCertificates, error) {
+	var err error
+	certs := &clientCertificates{hosts: make(map[string]*tls.Certificate)}
+	certs.fallback, err = loadClientCertificate(opt.ClientCert, opt.ClientKey, opt.ClientPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range splitList(opt.ClientCertFor) {
+		host, files, _ := strings.Cut(s, "=")
+		l := filepath.SplitList(files)
+		if host == "" || len(l) < 1 || len(l) > 2 || l[0] == "" {
+			return nil, fmt.Errorf("invalid --client-cert-for '%s' (should be HOST=CERT, or HOST=CERT:KEY)", s)
+		}
+		key := ""
+		if len(l) == 2 {
+			key = l[1]
+		}
+		cert, err := loadClientCertificate(l[0], key, opt.ClientPassword)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", host, err)
+		}
+		certs.hosts[strings.ToLower(host)] = cert
+	}
+	return certs, nil
+}
+
+// For returns the certificate to present to host, if any.
+func (c *clientCertificates) For(host string) *tls.Certificate {
+	if cert, ok := c.hosts[strings.ToLower(host)]; ok {
+		return cert
+	}
+	return c.fallback
+}
+
+// Dump prints which certificates will be presented to whom.
+func (c *clientCertificates) Dump(out io.Writer) {
+	if c.fallback != nil {
+		fmt.Fprintf(out, "presenting client certificate %s to upstream\n", c.fallback.Leaf.Subject)
+	}
+	hosts := make([]string, 0, len(c.hosts))
+	for host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(out, "presenting client certificate %s to %s\n", c.hosts[host].Leaf.Subject, host)
+	}
+}
+
+type upstreamHostKey struct{}
+
+// withUpstreamHost tells presentClientCertificate which host a request
+// made outside of an exchange (like a health check) is going to.
+func withUpstreamHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, upstreamHostKey{}, host)
+}
+
+// presentClientCertificate returns a tls.Config callback that hands
+// the client certificate configured for the upstream host (if any) to
+// upstreams that ask for one, noting in the exchange trace that they
+// asked.
+//
+// The certificate is sent even if the upstream's list of acceptable
+// CAs says it won't like it; seeing the upstream reject it is more
+// useful than not sending anything at all.
+func presentClientCertificate(certs *clientCertificates) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		t := traceFrom(info.Context())
+		host, _ := info.Context().Value(upstreamHostKey{}).(string)
+		if t != nil {
+			host = t.Host()
+		}
+
+		cert := certs.For(host)
+		if t != nil {
+			t.clientCertRequested(info, cert)
+		}
+
+		if cert == nil {
+			return &tls.Certificate{}, nil
+		}
+		return cert, nil
+	}
+}
+
+// clientAuthType works out how the --tls listener should treat client
+// certificates.  Clients can be asked for a certificate ("request"),
+// or made to present one ("require"); if we have CAs to verify them
+// against, we do, otherwise whatever gets presented is accepted.
+func clientAuthType(mode string, verify bool) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		if verify {
+			return tls.VerifyClientCertIfGiven, nil
+		}
+		return tls.RequestClientCert, nil
+	case "require":
+		if verify {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.RequireAnyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unrecognized client auth mode '%s' (must be one of none, request, or require)", mode)
+}
+
+// dumpClientCertificates prints the certificate chain that a client
+// presented to the --tls listener, if any.
+func dumpClientCertificates(out io.Writer, state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	if len(state.VerifiedChains) > 0 {
+		fmt.Fprintf(out, "@C{client certificates:} @G{(verified)}\n")
+	} else {
+		fmt.Fprintf(out, "@C{client certificates:} @Y{(not verified)}\n")
+	}
+	for i, cert := range state.PeerCertificates {
+		dumpCertificate(out, i, cert)
+	}
+	fmt.Fprintf(out, "\n")
+}
+
+// forwardClientCertificate passes the identity of the client on to the
+// upstream, the way the Cloud Foundry gorouter does, via the
+// X-Forwarded-Client-Cert header.  We never see the client's private
+// key, so we can't present its certificate in our own TLS handshake.
+func forwardClientCertificate(req *http.Request, state *tls.ConnectionState) {
+	req.Header.Del("X-Forwarded-Client-Cert")
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	req.Header.Set("X-Forwarded-Client-Cert", base64.StdEncoding.EncodeToString(state.PeerCertificates[0].Raw))
+}
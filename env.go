@@ -0,0 +1,79 @@
+package main
+
+import (
+	fmt "github.com/jhunt/go-ansi"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitList flattens a list of flag values, each of which may itself
+// be a comma- (or space-) separated list.
+func splitList(l []string) []string {
+	var out []string
+	for _, s := range l {
+		out = append(out, strings.Fields(strings.Replace(s, ",", " ", -1))...)
+	}
+	return out
+}
+
+// envFields splits a comma- (or space-) separated environment variable
+// into its fields.
+func envFields(name string) []string {
+	return splitList([]string{os.Getenv(name)})
+}
+
+// envBool sets *into if an environment variable is set to anything
+// but no, false or 0.
+func envBool(name string, into *bool) {
+	v := strings.ToLower(os.Getenv(name))
+	if v != "" && v != "no" && v != "false" && v != "0" {
+		*into = true
+	}
+}
+
+// envInt sets *into from an environment variable, if it is set.
+func envInt(name string, into *int) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid $%s '%s' (should be a number)", name, v)
+	}
+	*into = n
+	return nil
+}
+
+func envList(name string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	return filepath.SplitList(v)
+}
+
+// durationOption is a flag whose value is a duration, like 30s, which
+// go-cli only knows how to give us as a string.
+type durationOption struct {
+	flag  string
+	value string
+	into  *time.Duration
+}
+
+func parseDurations(options []durationOption) error {
+	for _, d := range options {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s '%s' (should be something like 30s, or 1m30s)", d.flag, d.value)
+		}
+		*d.into = v
+	}
+	return nil
+}
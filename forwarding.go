@@ -0,0 +1,179 @@
+package main
+
+import (
+	fmt "github.com/jhunt/go-ansi"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders only mean anything on one connection, so a proxy
+// isn't supposed to pass them on (RFC 7230, section 6.1), along with
+// any others that the Connection header names.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardingPolicy decides what gotcha does to the headers it relays,
+// as a proxy: stripping hop-by-hop headers (unless asked to behave like
+// a broken proxy that doesn't), and telling the upstream who the client
+// was, with X-Forwarded-*, Forwarded (RFC 7239) and Via headers, each
+// of which can be had or not, independently.
+type forwardingPolicy struct {
+	keepHopByHop bool
+
+	xForwardedFor   bool
+	xForwardedProto bool
+	xForwardedHost  bool
+
+	forwarded bool
+	via       bool
+}
+
+func parseForwardingPolicy(opt *Opt) (*forwardingPolicy, error) {
+	p := &forwardingPolicy{
+		keepHopByHop: opt.KeepHopByHop,
+		forwarded:    opt.Forwarded,
+		via:          opt.Via,
+	}
+	for _, which := range splitList(opt.XForwarded) {
+		switch strings.ToLower(which) {
+		case "for":
+			p.xForwardedFor = true
+		case "proto":
+			p.xForwardedProto = true
+		case "host":
+			p.xForwardedHost = true
+		case "all":
+			p.xForwardedFor, p.xForwardedProto, p.xForwardedHost = true, true, true
+		default:
+			return nil, fmt.Errorf("invalid --x-forwarded '%s' (should be for, proto, host or all)", which)
+		}
+	}
+	return p, nil
+}
+
+// stripHopByHop removes the hop-by-hop headers from h, including those
+// listed in its Connection header.  "TE: trailers" is left, since that
+// is what says the client (and so gotcha) can cope with trailers.
+func stripHopByHop(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	trailers := false
+	for _, value := range h["Te"] {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+				trailers = true
+			}
+		}
+	}
+	for _, header := range hopByHopHeaders {
+		h.Del(header)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// Request fixes up the headers of the request we are about to send the
+// upstream (out), given the one that the client sent us (in).
+func (p *forwardingPolicy) Request(out, in *http.Request) {
+	if !p.keepHopByHop {
+		stripHopByHop(out.Header)
+	}
+
+	client := hostOnly(in.RemoteAddr)
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	if p.xForwardedFor {
+		chain := client
+		if prior := strings.Join(out.Header["X-Forwarded-For"], ", "); prior != "" {
+			chain = prior + ", " + client
+		}
+		out.Header.Set("X-Forwarded-For", chain)
+	}
+	if p.xForwardedProto {
+		out.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if p.xForwardedHost {
+		out.Header.Set("X-Forwarded-Host", in.Host)
+	}
+
+	if p.forwarded {
+		element := fmt.Sprintf("for=%s;proto=%s", forwardedNode(client), proto)
+		if in.Host != "" {
+			element += ";host=" + forwardedValue(in.Host)
+		}
+		if prior := strings.Join(out.Header["Forwarded"], ", "); prior != "" {
+			element = prior + ", " + element
+		}
+		out.Header.Set("Forwarded", element)
+	}
+
+	if p.via {
+		addVia(out.Header, in.ProtoMajor, in.ProtoMinor)
+	}
+}
+
+// Response fixes up the headers of the response we are about to send
+// the client (out), given the one the upstream sent us (in).
+func (p *forwardingPolicy) Response(out http.Header, in *http.Response) {
+	if !p.keepHopByHop {
+		stripHopByHop(out)
+	}
+	if p.via {
+		addVia(out, in.ProtoMajor, in.ProtoMinor)
+	}
+}
+
+// forwardedNode formats an IP address for a Forwarded header, where
+// IPv6 addresses have to be bracketed, and quoted.
+func forwardedNode(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return fmt.Sprintf(`"[%s]"`, ip)
+	}
+	return ip
+}
+
+// forwardedValue quotes a Forwarded parameter value, if it has to be;
+// values that are HTTP tokens (hostnames without ports, mostly) don't.
+func forwardedValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+		return fmt.Sprintf("%q", v)
+	}
+	return v
+}
+
+// isTokenChar is true of the characters allowed in an HTTP token (the
+// tchar of RFC 7230, section 3.2.6).
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+func addVia(h http.Header, major, minor int) {
+	via := fmt.Sprintf("%d.%d gotcha", major, minor)
+	if prior := strings.Join(h["Via"], ", "); prior != "" {
+		via = prior + ", " + via
+	}
+	h.Set("Via", via)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStripHopByHop(t *testing.T) {
+	tests := []struct {
+		name string
+		in   http.Header
+		want http.Header
+	}{
+		{
+			name: "end-to-end headers stay",
+			in:   http.Header{"Accept": {"*/*"}, "Cache-Control": {"no-cache"}},
+			want: http.Header{"Accept": {"*/*"}, "Cache-Control": {"no-cache"}},
+		},
+		{
+			name: "the usual hop-by-hop headers go",
+			in: http.Header{
+				"Accept":              {"*/*"},
+				"Connection":          {"keep-alive"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Authorization": {"Basic c2Vrcml0"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Trailer":             {"Expires"},
+				"Transfer-Encoding":   {"chunked"},
+				"Upgrade":             {"websocket"},
+			},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name: "headers listed in Connection go too",
+			in: http.Header{
+				"Accept":      {"*/*"},
+				"Connection":  {"close, X-Hop", "x-other-hop"},
+				"X-Hop":       {"1"},
+				"X-Other-Hop": {"2"},
+				"X-End":       {"3"},
+			},
+			want: http.Header{"Accept": {"*/*"}, "X-End": {"3"}},
+		},
+		{
+			name: "TE: trailers stays",
+			in:   http.Header{"Te": {"trailers"}},
+			want: http.Header{"Te": {"trailers"}},
+		},
+		{
+			name: "TE: trailers stays, without the rest of TE",
+			in:   http.Header{"Te": {"gzip, trailers"}},
+			want: http.Header{"Te": {"trailers"}},
+		},
+		{
+			name: "other TE goes",
+			in:   http.Header{"Te": {"gzip, deflate"}},
+			want: http.Header{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stripHopByHop(test.in)
+			if got, want := headerString(test.in), headerString(test.want); got != want {
+				t.Errorf("got headers\n%s\nnot\n%s", got, want)
+			}
+		})
+	}
+}
+
+func headerString(h http.Header) string {
+	var l []string
+	for name, values := range h {
+		l = append(l, name+": "+strings.Join(values, ", "))
+	}
+	sort.Strings(l)
+	return strings.Join(l, "\n")
+}
+
+func TestForwardedValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"example.com:8080", `"example.com:8080"`},
+		{"[2001:db8::1]", `"[2001:db8::1]"`},
+		{"[2001:db8::1]:8080", `"[2001:db8::1]:8080"`},
+		{"has space", `"has space"`},
+		{`has"quote`, `"has\"quote"`},
+		{"", `""`},
+	}
+
+	for _, test := range tests {
+		if got := forwardedValue(test.in); got != test.want {
+			t.Errorf("forwardedValue('%s') is %s, not %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestForwardedHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		host   string
+		prior  string
+		want   string
+	}{
+		{"IPv4 client", "192.0.2.1:54321", "example.com", "", "for=192.0.2.1;proto=http;host=example.com"},
+		{"IPv6 client", "[2001:db8::1]:54321", "example.com", "", `for="[2001:db8::1]";proto=http;host=example.com`},
+		{"host with a port", "192.0.2.1:54321", "localhost:3128", "", `for=192.0.2.1;proto=http;host="localhost:3128"`},
+		{"earlier proxies", "192.0.2.1:54321", "example.com", "for=198.51.100.7", "for=198.51.100.7, for=192.0.2.1;proto=http;host=example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &forwardingPolicy{forwarded: true}
+			in, _ := http.NewRequest("GET", "http://gotcha.test/", nil)
+			in.RemoteAddr, in.Host = test.remote, test.host
+			out, _ := http.NewRequest("GET", "http://upstream.test/", nil)
+			if test.prior != "" {
+				out.Header.Set("Forwarded", test.prior)
+			}
+
+			p.Request(out, in)
+			if got := out.Header.Get("Forwarded"); got != test.want {
+				t.Errorf("got Forwarded: %s\nnot Forwarded: %s", got, test.want)
+			}
+		})
+	}
+}
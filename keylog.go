@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"os"
+	"sync"
+)
+
+// keyLog writes TLS session secrets out in the NSS key log format (the
+// one that $SSLKEYLOGFILE points at), so that a packet capture taken
+// while gotcha is running can be decrypted by Wireshark.  The secrets
+// of each connection are preceded by a comment saying which connection
+// they belong to (and for upstream connections, which exchange opened
+// it), so that the capture can be lined up with what gotcha dumped.
+type keyLog struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func openKeyLog(path string) (*keyLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &keyLog{out: f}, nil
+}
+
+// Writer returns an io.Writer for use as a tls.Config KeyLogWriter.
+// The label (if any) is asked for when the first secret is written,
+// part way through the handshake, by which time the connection is
+// known.
+func (k *keyLog) Writer(label func() string) io.Writer {
+	if k == nil {
+		return nil
+	}
+	return &keyLogWriter{log: k, label: label}
+}
+
+// Listen logs the secrets of every connection that the --tls listener
+// accepts, labelled with the addresses of either end.  Each connection
+// gets its own copy of the config, so that it can have its own label;
+// session ticket keys are still shared with the original.
+func (k *keyLog) Listen(config *tls.Config) {
+	if k == nil {
+		return
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.KeyLogWriter = k.Writer(func() string {
+			return fmt.Sprintf("client connection %s -> %s", hello.Conn.RemoteAddr(), hello.Conn.LocalAddr())
+		})
+		return c, nil
+	}
+}
+
+type keyLogWriter struct {
+	log      *keyLog
+	label    func() string
+	labelled bool
+}
+
+func (w *keyLogWriter) Write(p []byte) (int, error) {
+	w.log.lock.Lock()
+	defer w.log.lock.Unlock()
+
+	if !w.labelled && w.label != nil {
+		w.labelled = true
+		if label := w.label(); label != "" {
+			io.WriteString(w.log.out, "# "+label+"\n")
+		}
+	}
+	return w.log.out.Write(p)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	fmt "github.com/jhunt/go-ansi"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The key types that gotcha knows how to generate, for --key-type.
+var keyTypes = []string{"rsa2048", "rsa3072", "rsa4096", "ecdsa-p256", "ecdsa-p384", "ed25519"}
+
+// keySize works out what --key-type means: an RSA key of some number
+// of bits, an ECDSA key on some curve, or (with neither) Ed25519.
+func keySize(keyType string) (int, elliptic.Curve, error) {
+	switch strings.ToLower(keyType) {
+	case "", "rsa", "rsa2048":
+		return 2048, nil, nil
+	case "rsa3072":
+		return 3072, nil, nil
+	case "rsa4096":
+		return 4096, nil, nil
+	case "ecdsa", "ecdsa-p256", "p256":
+		return 0, elliptic.P256(), nil
+	case "ecdsa-p384", "p384":
+		return 0, elliptic.P384(), nil
+	case "ed25519":
+		return 0, nil, nil
+	}
+	return 0, nil, fmt.Errorf("unrecognized key type '%s' (must be one of %s)", keyType, strings.Join(keyTypes, ", "))
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	bits, curve, err := keySize(keyType)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bits > 0:
+		return rsa.GenerateKey(rand.Reader, bits)
+	case curve != nil:
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// checkKeyOptions makes sure that --key-type is one gotcha knows, and
+// that --signature can be used with it, before going to the trouble of
+// generating a key (or touching any files).
+func checkKeyOptions(keyType, scheme string) error {
+	bits, curve, err := keySize(keyType)
+	if err != nil {
+		return err
+	}
+	var pub crypto.PublicKey = ed25519.PublicKey(nil)
+	switch {
+	case bits > 0:
+		pub = &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), uint(bits-1))}
+	case curve != nil:
+		pub = &ecdsa.PublicKey{Curve: curve}
+	}
+	_, err = signatureAlgorithm(pub, scheme)
+	return err
+}
+
+// signatureAlgorithm picks the algorithm that a key (the issuer's) will
+// sign certificates with.  The scheme names a hash (sha256, sha384 or
+// sha512), optionally suffixed with -pss for RSA keys; if it is empty,
+// crypto/x509 gets to choose.  Ed25519 keys only have one way of
+// signing things, so the scheme doesn't matter for them.
+func signatureAlgorithm(pub crypto.PublicKey, scheme string) (x509.SignatureAlgorithm, error) {
+	scheme = strings.ToLower(scheme)
+	if scheme == "" {
+		return x509.UnknownSignatureAlgorithm, nil
+	}
+
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch scheme {
+		case "sha256":
+			return x509.SHA256WithRSA, nil
+		case "sha384":
+			return x509.SHA384WithRSA, nil
+		case "sha512":
+			return x509.SHA512WithRSA, nil
+		case "sha256-pss":
+			return x509.SHA256WithRSAPSS, nil
+		case "sha384-pss":
+			return x509.SHA384WithRSAPSS, nil
+		case "sha512-pss":
+			return x509.SHA512WithRSAPSS, nil
+		}
+
+	case *ecdsa.PublicKey:
+		switch scheme {
+		case "sha256":
+			return x509.ECDSAWithSHA256, nil
+		case "sha384":
+			return x509.ECDSAWithSHA384, nil
+		case "sha512":
+			return x509.ECDSAWithSHA512, nil
+		}
+
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("signature scheme '%s' cannot be used with %s keys", scheme, keyDescription(pub))
+}
+
+func keyDescription(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
+// encodePrivateKey PEM-encodes a private key, as PKCS#8.
+func encodePrivateKey(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	})), nil
+}
+
+// parsePrivateKey decodes a PEM private key, be it PKCS#8 (encrypted
+// with passphrase, or not), or one of the older PKCS#1 (RSA) or SEC 1
+// (ECDSA) formats.
+func parsePrivateKey(block *pem.Block, passphrase string) (crypto.Signer, error) {
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == "" {
+			return nil, errors.New("private key is encrypted, but no passphrase was given")
+		}
+		der, err := decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return parsePrivateKey(&pem.Block{Type: "PRIVATE KEY", Bytes: der}, "")
+
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return nil, errors.New("unrecognized private key format '" + block.Type + "'")
+}
+
+/* PKCS#8 private key encryption, using PBES2 (RFC 8018), with
+   PBKDF2-HMAC-SHA256 for deriving the key and AES-256-CBC for the
+   encryption; the same as `openssl pkcs8 -topk8 -v2 aes-256-cbc`. */
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+const pbkdf2Iterations = 600000
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Cipher pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func algorithm(oid asn1.ObjectIdentifier, params interface{}) (pkix.AlgorithmIdentifier, error) {
+	der, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.RawValue{FullBytes: der}}, nil
+}
+
+// encodeEncryptedPrivateKey PEM-encodes a private key as PKCS#8,
+// encrypted with a key derived from the passphrase.
+func encodeEncryptedPrivateKey(key crypto.Signer, passphrase string) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, pbkdf2Iterations, 32, sha256.New))
+	if err != nil {
+		return "", err
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	prf, err := algorithm(oidHMACWithSHA256, asn1.NullRawValue)
+	if err != nil {
+		return "", err
+	}
+	kdf, err := algorithm(oidPBKDF2, pbkdf2Params{Salt: salt, Iterations: pbkdf2Iterations, KeyLength: 32, PRF: prf})
+	if err != nil {
+		return "", err
+	}
+	enc, err := algorithm(oidAES256CBC, iv)
+	if err != nil {
+		return "", err
+	}
+	alg, err := algorithm(oidPBES2, pbes2Params{KDF: kdf, Cipher: enc})
+	if err != nil {
+		return "", err
+	}
+
+	b, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: alg, Data: data})
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "ENCRYPTED PRIVATE KEY",
+		Bytes: b,
+	})), nil
+}
+
+func decryptPKCS8(der []byte, passphrase string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %s (only PBES2 is supported)", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) || !params.Cipher.Algorithm.Equal(oidAES256CBC) {
+		return nil, errors.New("unsupported private key encryption (only PBKDF2 with AES-256-CBC is supported)")
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	if !kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, errors.New("unsupported private key encryption (only PBKDF2 with HMAC-SHA256 is supported)")
+	}
+	if kdf.Iterations < 1 || (kdf.KeyLength != 0 && kdf.KeyLength != 32) {
+		return nil, errors.New("malformed encrypted private key")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), kdf.Salt, kdf.Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.Data)
+
+	/* a wrong passphrase (almost always) shows up as bad padding; the
+	   length checks above mean that there are at least pad bytes */
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(data[len(data)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("incorrect passphrase for private key")
+	}
+	return data[:len(data)-pad], nil
+}
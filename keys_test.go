@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+)
+
+type publicKey interface {
+	Equal(crypto.PublicKey) bool
+}
+
+func decodePEM(t *testing.T, s string) *pem.Block {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		t.Fatalf("failed to decode PEM:\n%s", s)
+	}
+	return block
+}
+
+func TestEncryptedPrivateKeyRoundTrip(t *testing.T) {
+	for _, keyType := range keyTypes {
+		t.Run(keyType, func(t *testing.T) {
+			key, err := generateKey(keyType)
+			if err != nil {
+				t.Fatalf("failed to generate key: %s", err)
+			}
+			s, err := encodeEncryptedPrivateKey(key, "sekrit")
+			if err != nil {
+				t.Fatalf("failed to encrypt key: %s", err)
+			}
+
+			block := decodePEM(t, s)
+			if block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Fatalf("got a PEM block of type '%s', not ENCRYPTED PRIVATE KEY", block.Type)
+			}
+			got, err := parsePrivateKey(block, "sekrit")
+			if err != nil {
+				t.Fatalf("failed to decrypt key: %s", err)
+			}
+			if !got.Public().(publicKey).Equal(key.Public()) {
+				t.Errorf("decrypted key does not match the original")
+			}
+		})
+	}
+}
+
+func TestEncryptedPrivateKeyWrongPassphrase(t *testing.T) {
+	key, err := generateKey("ecdsa-p256")
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	s, err := encodeEncryptedPrivateKey(key, "sekrit")
+	if err != nil {
+		t.Fatalf("failed to encrypt key: %s", err)
+	}
+	block := decodePEM(t, s)
+
+	for _, passphrase := range []string{"wrong", "Sekrit", "sekrit ", "x"} {
+		if _, err := parsePrivateKey(block, passphrase); err == nil {
+			t.Errorf("decrypted the key with passphrase '%s'", passphrase)
+		}
+	}
+	if _, err := parsePrivateKey(block, ""); err == nil {
+		t.Errorf("decrypted the key with no passphrase")
+	}
+}
+
+func TestEncryptedPrivateKeyBadPadding(t *testing.T) {
+	key, err := generateKey("ecdsa-p256")
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	s, err := encodeEncryptedPrivateKey(key, "sekrit")
+	if err != nil {
+		t.Fatalf("failed to encrypt key: %s", err)
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(decodePEM(t, s).Bytes, &info); err != nil {
+		t.Fatalf("failed to parse encrypted key: %s", err)
+	}
+	/* in CBC, flipping bits of one ciphertext block flips the same bits
+	   of the next plaintext block; this makes the last (padding) byte
+	   at least 0xef, which can't be right */
+	info.Data[len(info.Data)-17] ^= 0xff
+	der, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatalf("failed to re-encode encrypted key: %s", err)
+	}
+	if _, err := decryptPKCS8(der, "sekrit"); err == nil {
+		t.Errorf("decrypted a key with bad padding")
+	}
+}
+
+func TestEncryptedPrivateKeyFromOpenSSL(t *testing.T) {
+	/* made with `openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256` */
+	enc, err := ioutil.ReadFile("testdata/openssl-pbes2.pem")
+	if err != nil {
+		t.Fatalf("failed to read encrypted key: %s", err)
+	}
+	plain, err := ioutil.ReadFile("testdata/openssl-pbes2.plain.pem")
+	if err != nil {
+		t.Fatalf("failed to read plaintext key: %s", err)
+	}
+
+	got, err := parsePrivateKey(decodePEM(t, string(enc)), "gotcha-test")
+	if err != nil {
+		t.Fatalf("failed to decrypt key: %s", err)
+	}
+	want, err := parsePrivateKey(decodePEM(t, string(plain)), "")
+	if err != nil {
+		t.Fatalf("failed to parse plaintext key: %s", err)
+	}
+	if !got.Public().(publicKey).Equal(want.Public()) {
+		t.Errorf("decrypted key does not match the plaintext one")
+	}
+
+	if _, err := parsePrivateKey(decodePEM(t, string(enc)), "not-gotcha-test"); err == nil {
+		t.Errorf("decrypted the key with the wrong passphrase")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	fmt "github.com/jhunt/go-ansi"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leafCache keeps the leaf certificates that gotcha mints for --tls, in
+// memory and (unless the CA is ephemeral) on disk, next to the CA, so
+// that restarts don't have to generate new keys, and clients that pin
+// the leaf keep working.  Leaves are keyed by the set of names they are
+// for, the CA that signed them, and how they were generated, and are
+// re-issued once they are two-thirds of the way through their life.
+type leafCache struct {
+	lock sync.Mutex
+
+	ca      *Cert
+	dir     string
+	ttl     time.Duration
+	keyType string
+	scheme  string
+
+	leaves map[string]*tls.Certificate
+}
+
+func newLeafCache(ca *Cert, dir string, ttl time.Duration, keyType, scheme string) *leafCache {
+	return &leafCache{
+		ca:      ca,
+		dir:     dir,
+		ttl:     ttl,
+		keyType: keyType,
+		scheme:  scheme,
+		leaves:  make(map[string]*tls.Certificate),
+	}
+}
+
+func (c *leafCache) key(names []string) string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		fingerprint(c.ca.RawCertificate),
+		c.keyType,
+		c.scheme,
+		strings.Join(sorted, ","),
+	}, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *leafCache) fresh(cert *tls.Certificate) bool {
+	if cert == nil || cert.Leaf == nil {
+		return false
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return time.Now().Before(cert.Leaf.NotAfter.Add(-lifetime / 3))
+}
+
+func (c *leafCache) path(key string) string {
+	return filepath.Join(c.dir, key+".pem")
+}
+
+func (c *leafCache) load(key string) *tls.Certificate {
+	if c.dir == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	pair, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil
+	}
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return nil
+	}
+	if pair.Leaf.CheckSignatureFrom(c.ca.RawCertificate) != nil {
+		return nil
+	}
+	return &pair
+}
+
+func (c *leafCache) store(key string, cert *Cert) {
+	if c.dir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "@Y{unable to cache certificate:} %s\n", err)
+		return
+	}
+	if err := writeFile(c.path(key), []byte(cert.Certificate+cert.Key), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "@Y{unable to cache certificate:} %s\n", err)
+	}
+}
+
+// Get returns a leaf certificate for the given names, from the cache
+// if there is a fresh enough one there, or newly minted if not.
+func (c *leafCache) Get(names []string) (*tls.Certificate, error) {
+	key := c.key(names)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cert := c.leaves[key]; c.fresh(cert) {
+		return cert, nil
+	}
+
+	if cert := c.load(key); c.fresh(cert) {
+		fmt.Fprintf(os.Stderr, "using cached certificate for %s (expires %s)\n", strings.Join(names, ", "), cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+		c.leaves[key] = cert
+		return cert, nil
+	}
+
+	leaf, err := leafCertificate(names, c.ttl, c.keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a certificate: %s", err)
+	}
+	if err := c.ca.Sign(leaf, c.scheme); err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %s", err)
+	}
+	pair, err := tls.X509KeyPair([]byte(leaf.Certificate), []byte(leaf.Key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+	pair.Leaf = leaf.RawCertificate
+
+	fmt.Fprintf(os.Stderr, "issued a new certificate for %s (expires %s)\n", strings.Join(names, ", "), pair.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	c.store(key, leaf)
+	c.leaves[key] = &pair
+	return &pair, nil
+}
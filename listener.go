@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	fmt "github.com/jhunt/go-ansi"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listenerOptions protect gotcha from its clients; how long it waits
+// for them, and how many of them it will talk to at once.  Zero means
+// no limit, for all of them.
+type listenerOptions struct {
+	readTimeout   time.Duration
+	headerTimeout time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+
+	maxConns      int
+	maxConnsPerIP int
+}
+
+func parseListenerOptions(opt *Opt) (listenerOptions, error) {
+	o := listenerOptions{
+		maxConns:      opt.MaxConns,
+		maxConnsPerIP: opt.MaxConnsPerIP,
+	}
+
+	err := parseDurations([]durationOption{
+		{"--read-timeout", opt.ReadTimeout, &o.readTimeout},
+		{"--header-timeout", opt.HeaderTimeout, &o.headerTimeout},
+		{"--write-timeout", opt.WriteTimeout, &o.writeTimeout},
+		{"--idle-timeout", opt.IdleTimeout, &o.idleTimeout},
+	})
+	return o, err
+}
+
+// Apply sets the timeouts on the server, and has it tell the listener
+// what each connection is up to, so that when one times out, we can
+// say which timeout it was.
+func (o listenerOptions) Apply(server *http.Server) {
+	server.ReadTimeout = o.readTimeout
+	server.ReadHeaderTimeout = o.headerTimeout
+	server.WriteTimeout = o.writeTimeout
+	server.IdleTimeout = o.idleTimeout
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if c := unwrapClientConn(conn); c != nil {
+			atomic.StoreInt32(&c.state, int32(state))
+		}
+	}
+}
+
+// clientListener hands the connections it accepts to the server, unless
+// there are already too many, in total or from the same client IP, in
+// which case they are closed straight away.
+type clientListener struct {
+	net.Listener
+
+	lock  sync.Mutex
+	total int
+	byIP  map[string]int
+
+	max   int
+	perIP int
+}
+
+func newClientListener(l net.Listener, o listenerOptions) *clientListener {
+	return &clientListener{
+		Listener: l,
+		byIP:     make(map[string]int),
+		max:      o.maxConns,
+		perIP:    o.maxConnsPerIP,
+	}
+}
+
+func (l *clientListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := hostOnly(conn.RemoteAddr().String())
+		l.lock.Lock()
+		switch {
+		case l.max > 0 && l.total >= l.max:
+			l.lock.Unlock()
+			dropped(conn, fmt.Sprintf("already at --max-conns (%d)", l.max))
+			conn.Close()
+			continue
+
+		case l.perIP > 0 && l.byIP[ip] >= l.perIP:
+			l.lock.Unlock()
+			dropped(conn, fmt.Sprintf("already at --max-conns-per-ip (%d) for %s", l.perIP, ip))
+			conn.Close()
+			continue
+		}
+		l.total++
+		l.byIP[ip]++
+		l.lock.Unlock()
+
+		return &clientConn{Conn: conn, listener: l, ip: ip}, nil
+	}
+}
+
+func (l *clientListener) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+func dropped(conn net.Conn, why string) {
+	fmt.Fprintf(os.Stderr, "@Y{dropped connection from %s:} %s\n", conn.RemoteAddr(), why)
+}
+
+// clientConn is a connection from a client, which gives back its slot
+// in the listener when it is closed, and logs it when it times out.
+type clientConn struct {
+	net.Conn
+	listener *clientListener
+	ip       string
+	state    int32
+
+	lock          sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closed  sync.Once
+	timeout sync.Once
+}
+
+func unwrapClientConn(conn net.Conn) *clientConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, _ := conn.(*clientConn)
+	return c
+}
+
+func (c *clientConn) Close() error {
+	c.closed.Do(func() { c.listener.release(c.ip) })
+	return c.Conn.Close()
+}
+
+// The server sets deadlines in the past to interrupt reads of its own
+// (when a handler finishes, say), which look just like timeouts; only
+// deadlines that were still ahead when the read or write started count.
+func (c *clientConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.lock.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *clientConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *clientConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *clientConn) timedOut(err error, started time.Time, deadline *time.Time, what string) {
+	var nerr net.Error
+	if err == nil || !errors.As(err, &nerr) || !nerr.Timeout() {
+		return
+	}
+	c.lock.Lock()
+	interrupted := deadline.Before(started)
+	c.lock.Unlock()
+	if interrupted {
+		return
+	}
+	c.timeout.Do(func() {
+		switch http.ConnState(atomic.LoadInt32(&c.state)) {
+		case http.StateIdle:
+			dropped(c, "idle for longer than --idle-timeout")
+		case http.StateNew:
+			dropped(c, fmt.Sprintf("timed out %s the TLS handshake or request headers", what))
+		default:
+			dropped(c, fmt.Sprintf("timed out %s the request or response", what))
+		}
+	})
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	started := time.Now()
+	n, err := c.Conn.Read(b)
+	c.timedOut(err, started, &c.readDeadline, "reading")
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	started := time.Now()
+	n, err := c.Conn.Write(b)
+	c.timedOut(err, started, &c.writeDeadline, "writing")
+	return n, err
+}
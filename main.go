@@ -2,24 +2,19 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/base64"
-	"encoding/pem"
-	"errors"
 	fmt "github.com/jhunt/go-ansi"
 	"io"
 	"io/ioutil"
-	"math/big"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jhunt/go-cli"
@@ -28,9 +23,13 @@ import (
 func timing(step string, f func()) {
 	start := time.Now()
 	f()
-	end := time.Now()
-	took := float64(end.UnixNano()-start.UnixNano()) / 1000000
-	fmt.Fprintf(os.Stderr, "@G{%5.3f ms} to %s\n", took, step)
+	tookTime(step, time.Since(start))
+}
+
+// tookTime says how long a step took, for steps that can't be wrapped
+// up in timing.
+func tookTime(step string, d time.Duration) {
+	fmt.Fprintf(os.Stderr, "@G{%5.3f ms} to %s\n", float64(d.Nanoseconds())/1000000, step)
 }
 
 var Version string
@@ -42,229 +41,683 @@ type Opt struct {
 	OnlyHeaders bool `cli:"-H, --only-headers"`
 	Redirect    bool `cli:"-r, --redirect"`
 	KeepReferer bool `cli:"--keep-referer"`
+	RewriteURLs bool `cli:"--rewrite-urls"`
 	TLS         bool `cli:"--tls"`
+
+	CAFile  []string `cli:"--ca-file"`
+	CAPath  string   `cli:"--ca-path"`
+	CACerts string   `cli:"--ca-certs"`
+
+	ClientCert     string   `cli:"--client-cert"`
+	ClientKey      string   `cli:"--client-key"`
+	ClientPassword string   `cli:"--client-password"`
+	ClientCertFor  []string `cli:"--client-cert-for"`
+
+	ClientAuth        string   `cli:"--client-auth"`
+	ClientCA          []string `cli:"--client-ca"`
+	ForwardClientCert bool     `cli:"--forward-client-cert"`
+
+	CADir        string `cli:"--ca-dir"`
+	CAPassphrase string `cli:"--ca-passphrase"`
+	EphemeralCA  bool   `cli:"--ephemeral-ca"`
+
+	TLSCert []string `cli:"--tls-cert"`
+	TLSKey  []string `cli:"--tls-key"`
+
+	KeyType   string   `cli:"--key-type"`
+	Signature string   `cli:"--signature"`
+	SANs      []string `cli:"--san"`
+
+	UpstreamTLSMin  string   `cli:"--upstream-tls-min"`
+	UpstreamTLSMax  string   `cli:"--upstream-tls-max"`
+	UpstreamCiphers []string `cli:"--upstream-ciphers"`
+	UpstreamCurves  []string `cli:"--upstream-curves"`
+	SNI             string   `cli:"--sni"`
+
+	PreserveHost bool   `cli:"--preserve-host"`
+	HostHeader   string `cli:"--host-header"`
+
+	TLSMin     string   `cli:"--tls-min"`
+	TLSMax     string   `cli:"--tls-max"`
+	TLSCiphers []string `cli:"--tls-ciphers"`
+	TLSCurves  []string `cli:"--tls-curves"`
+
+	CheckRevocation bool `cli:"--check-revocation"`
+
+	UpstreamMaxIdle           int    `cli:"--upstream-max-idle"`
+	UpstreamMaxIdlePerHost    int    `cli:"--upstream-max-idle-per-host"`
+	UpstreamMaxConns          int    `cli:"--upstream-max-conns"`
+	UpstreamIdleTimeout       string `cli:"--upstream-idle-timeout"`
+	UpstreamDialTimeout       string `cli:"--upstream-dial-timeout"`
+	UpstreamTLSTimeout        string `cli:"--upstream-tls-timeout"`
+	UpstreamResponseTimeout   string `cli:"--upstream-response-timeout"`
+	UpstreamKeepAlive         string `cli:"--upstream-keepalive"`
+	UpstreamDisableKeepAlives bool   `cli:"--upstream-disable-keepalives"`
+
+	Resolve   []string `cli:"--resolve"`
+	DNSServer string   `cli:"--dns-server"`
+
+	Balance        string `cli:"--balance"`
+	StickyCookie   string `cli:"--sticky-cookie"`
+	HealthCheck    string `cli:"--health-check"`
+	HealthInterval string `cli:"--health-interval"`
+	EjectAfter     int    `cli:"--eject-after"`
+	EjectFor       string `cli:"--eject-for"`
+
+	Retries         int      `cli:"--retries"`
+	RetryBackoff    string   `cli:"--retry-backoff"`
+	RetryMaxBackoff string   `cli:"--retry-max-backoff"`
+	RetryOn         []string `cli:"--retry-on"`
+	RetryAnyMethod  bool     `cli:"--retry-any-method"`
+
+	ReadTimeout   string `cli:"--read-timeout"`
+	HeaderTimeout string `cli:"--header-timeout"`
+	WriteTimeout  string `cli:"--write-timeout"`
+	IdleTimeout   string `cli:"--idle-timeout"`
+	MaxConns      int    `cli:"--max-conns"`
+	MaxConnsPerIP int    `cli:"--max-conns-per-ip"`
+
+	RouteService bool `cli:"--route-service"`
+
+	KeepHopByHop bool     `cli:"--keep-hop-by-hop"`
+	XForwarded   []string `cli:"--x-forwarded"`
+	Forwarded    bool     `cli:"--forwarded"`
+	Via          bool     `cli:"--via"`
+
+	MaxRedirects       int      `cli:"--max-redirects"`
+	SameHostRedirects  bool     `cli:"--same-host-redirects"`
+	RedirectKeepMethod bool     `cli:"--redirect-keep-method"`
+	RedirectForward    []string `cli:"--redirect-forward"`
+	RedirectStrip      []string `cli:"--redirect-strip"`
+
+	KeyLog string `cli:"--keylog"`
+	Pcap   string `cli:"--pcap"`
+
+	CA CAOpt `cli:"ca"`
 }
 
 func usage(out io.Writer) {
-	fmt.Fprintf(out, "Usage: @G{gotcha} [-hHNv] @C{https://target.system} [local port]\n\n")
+	fmt.Fprintf(out, "Usage: @G{gotcha} [-hHNv] @C{https://target.system} [local port]\n")
+	fmt.Fprintf(out, "       @G{gotcha} ca @C{COMMAND} [options]   (see `gotcha ca -h`)\n\n")
 	fmt.Fprintf(out, "  -h, --help           Show this help screen\n")
 	fmt.Fprintf(out, "  -v, --version        Print version information and exit\n")
 	fmt.Fprintf(out, "  -H, --only-headers   Only dump HTTP request/response headers (skip the body).\n")
 	fmt.Fprintf(out, "  -k, --no-verify      Do not verify TLS/SSL certificates.\n")
+	fmt.Fprintf(out, "      --ca-file FILE   Trust the PEM CA certificate(s) in FILE, in addition\n")
+	fmt.Fprintf(out, "                       to the system roots, when verifying the upstream.\n")
+	fmt.Fprintf(out, "                       Can be given more than once.\n")
+	fmt.Fprintf(out, "      --ca-path DIR    Trust all PEM CA certificates found in DIR.\n")
+	fmt.Fprintf(out, "      --ca-certs PEM   Trust the PEM CA certificate(s) given inline.\n")
+	fmt.Fprintf(out, "      --client-cert FILE\n")
+	fmt.Fprintf(out, "                       Present the certificate in FILE to upstreams that\n")
+	fmt.Fprintf(out, "                       ask for one (mutual TLS).  FILE is either PEM, or\n")
+	fmt.Fprintf(out, "                       a PKCS#12 bundle.\n")
+	fmt.Fprintf(out, "      --client-key FILE\n")
+	fmt.Fprintf(out, "                       PEM private key for --client-cert, if it is not\n")
+	fmt.Fprintf(out, "                       in the same file as the certificate.\n")
+	fmt.Fprintf(out, "      --client-password PASSWORD\n")
+	fmt.Fprintf(out, "                       Password for a PKCS#12 --client-cert (or any of the\n")
+	fmt.Fprintf(out, "                       --client-cert-for bundles).\n")
+	fmt.Fprintf(out, "      --client-cert-for HOST=CERT[:KEY]\n")
+	fmt.Fprintf(out, "                       Present CERT (with KEY, if it is kept apart) to\n")
+	fmt.Fprintf(out, "                       upstream HOST, instead of --client-cert.  Can be\n")
+	fmt.Fprintf(out, "                       given more than once, for different backends.\n")
 	fmt.Fprintf(out, "  -r, --redirect       Rewrite and return 3xx redirects.\n")
 	fmt.Fprintf(out, "      --keep-referer   Pass Referer: headers through, even with -r.\n")
+	fmt.Fprintf(out, "      --rewrite-urls   Point URLs to the upstream at gotcha instead, in\n")
+	fmt.Fprintf(out, "                       text response bodies, Location, Content-Location,\n")
+	fmt.Fprintf(out, "                       Link and Access-Control-Allow-Origin headers, and\n")
+	fmt.Fprintf(out, "                       cookie domains.\n")
+	fmt.Fprintf(out, "      --max-redirects N\n")
+	fmt.Fprintf(out, "                       Without -r, follow at most N redirects (default\n")
+	fmt.Fprintf(out, "                       10), and return the next one to the client.\n")
+	fmt.Fprintf(out, "      --same-host-redirects\n")
+	fmt.Fprintf(out, "                       Only follow redirects to the same host; return\n")
+	fmt.Fprintf(out, "                       the others to the client.\n")
+	fmt.Fprintf(out, "      --redirect-keep-method\n")
+	fmt.Fprintf(out, "                       Keep the method (and body) when following 301 and\n")
+	fmt.Fprintf(out, "                       302 redirects, rather than switching to GET.\n")
+	fmt.Fprintf(out, "      --redirect-forward HEADER[,HEADER...]\n")
+	fmt.Fprintf(out, "      --redirect-strip HEADER[,HEADER...]\n")
+	fmt.Fprintf(out, "                       Send (or don't send) these headers when following\n")
+	fmt.Fprintf(out, "                       a redirect to another origin.  Authorization,\n")
+	fmt.Fprintf(out, "                       Proxy-Authorization, Cookie, Cookie2 and\n")
+	fmt.Fprintf(out, "                       WWW-Authenticate aren't, unless forwarded.\n")
 	fmt.Fprintf(out, "      --tls            Present TLS (with a custom CA) to clients connecting\n")
-	fmt.Fprintf(out, "                       to us.  The CA will be dumped to standard error.\n")
+	fmt.Fprintf(out, "                       to us.  If there is no CA yet (see `gotcha ca init`\n")
+	fmt.Fprintf(out, "                       and --ephemeral-ca), one is generated, and dumped\n")
+	fmt.Fprintf(out, "                       to standard error.\n")
+	fmt.Fprintf(out, "      --ca-dir DIR     Where the gotcha CA lives (default $HOME/.gotcha).\n")
+	fmt.Fprintf(out, "      --ca-passphrase PASSPHRASE\n")
+	fmt.Fprintf(out, "                       The passphrase that the CA private key is (or will\n")
+	fmt.Fprintf(out, "                       be) encrypted with.\n")
+	fmt.Fprintf(out, "      --ephemeral-ca   Sign the --tls certificate with a throwaway CA that\n")
+	fmt.Fprintf(out, "                       only lives in memory.  Its certificate is dumped to\n")
+	fmt.Fprintf(out, "                       standard error, so that clients can be told to\n")
+	fmt.Fprintf(out, "                       trust it.  Implies --tls.\n")
+	fmt.Fprintf(out, "      --tls-cert FILE  Present the PEM certificate (chain) in FILE, instead\n")
+	fmt.Fprintf(out, "                       of one signed by the gotcha CA.  Implies --tls.\n")
+	fmt.Fprintf(out, "                       Can be given more than once, in which case the\n")
+	fmt.Fprintf(out, "                       certificate is chosen by the name the client asks\n")
+	fmt.Fprintf(out, "                       for (SNI).  Changes to the file are picked up\n")
+	fmt.Fprintf(out, "                       automatically.\n")
+	fmt.Fprintf(out, "      --tls-key FILE   PEM private key for the matching --tls-cert, if it\n")
+	fmt.Fprintf(out, "                       is not in the same file as the certificate.\n")
+	fmt.Fprintf(out, "      --san NAME       Put NAME (a hostname or IP) in the certificate that\n")
+	fmt.Fprintf(out, "                       --tls presents, instead of the names and addresses\n")
+	fmt.Fprintf(out, "                       of the interfaces we bind.  Can be given more than\n")
+	fmt.Fprintf(out, "                       once.\n")
+	fmt.Fprintf(out, "      --key-type TYPE  What kind of key to generate for --tls (and for\n")
+	fmt.Fprintf(out, "                       `gotcha ca`): one of rsa2048 (the default),\n")
+	fmt.Fprintf(out, "                       rsa3072, rsa4096, ecdsa-p256, ecdsa-p384, ed25519.\n")
+	fmt.Fprintf(out, "      --signature SCHEME\n")
+	fmt.Fprintf(out, "                       How the CA signs certificates: sha256, sha384 or\n")
+	fmt.Fprintf(out, "                       sha512, with a -pss suffix for RSA-PSS.\n")
+	fmt.Fprintf(out, "      --client-auth MODE\n")
+	fmt.Fprintf(out, "                       With --tls, ask clients for a certificate (MODE is\n")
+	fmt.Fprintf(out, "                       'request'), or insist on one ('require').\n")
+	fmt.Fprintf(out, "      --client-ca FILE Verify client certificates against the PEM CA(s)\n")
+	fmt.Fprintf(out, "                       in FILE.  Otherwise, any certificate is accepted.\n")
+	fmt.Fprintf(out, "      --forward-client-cert\n")
+	fmt.Fprintf(out, "                       Pass the client's certificate to the upstream in\n")
+	fmt.Fprintf(out, "                       an X-Forwarded-Client-Cert header.\n")
+	fmt.Fprintf(out, "      --upstream-tls-min VERSION, --upstream-tls-max VERSION\n")
+	fmt.Fprintf(out, "                       Only speak TLS versions (1.0, 1.1, 1.2 or 1.3) in\n")
+	fmt.Fprintf(out, "                       this range to the upstream.\n")
+	fmt.Fprintf(out, "      --upstream-ciphers SUITE[,SUITE...]\n")
+	fmt.Fprintf(out, "                       Only offer these cipher suites (by IANA name, or\n")
+	fmt.Fprintf(out, "                       number) to the upstream.  TLS 1.3 suites cannot\n")
+	fmt.Fprintf(out, "                       be restricted.\n")
+	fmt.Fprintf(out, "      --upstream-curves CURVE[,CURVE...]\n")
+	fmt.Fprintf(out, "                       Only offer these key exchange groups (P256, P384,\n")
+	fmt.Fprintf(out, "                       P521, X25519, or a number) to the upstream.\n")
+	fmt.Fprintf(out, "      --sni NAME       Send NAME as the server name (SNI) to the upstream,\n")
+	fmt.Fprintf(out, "                       and verify its certificate against NAME.\n")
+	fmt.Fprintf(out, "      --preserve-host  Send the client's Host header to the upstream,\n")
+	fmt.Fprintf(out, "                       rather than the upstream's own host.\n")
+	fmt.Fprintf(out, "      --host-header HOST\n")
+	fmt.Fprintf(out, "                       Send HOST as the Host header to the upstream.\n")
+	fmt.Fprintf(out, "      --tls-min VERSION, --tls-max VERSION, --tls-ciphers SUITE[,SUITE...],\n")
+	fmt.Fprintf(out, "      --tls-curves CURVE[,CURVE...]\n")
+	fmt.Fprintf(out, "                       The same, for clients of the --tls listener.\n")
+	fmt.Fprintf(out, "      --upstream-max-idle N\n")
+	fmt.Fprintf(out, "                       Keep at most N idle upstream connections around\n")
+	fmt.Fprintf(out, "                       for reuse (default 100), and at most\n")
+	fmt.Fprintf(out, "      --upstream-max-idle-per-host N\n")
+	fmt.Fprintf(out, "                       N to any one host (default 10).\n")
+	fmt.Fprintf(out, "      --upstream-max-conns N\n")
+	fmt.Fprintf(out, "                       Open at most N connections to any one upstream\n")
+	fmt.Fprintf(out, "                       host; requests wait for one to be free.\n")
+	fmt.Fprintf(out, "      --upstream-idle-timeout DURATION\n")
+	fmt.Fprintf(out, "                       Close idle upstream connections after DURATION\n")
+	fmt.Fprintf(out, "                       (default 90s).\n")
+	fmt.Fprintf(out, "      --upstream-dial-timeout DURATION, --upstream-tls-timeout DURATION,\n")
+	fmt.Fprintf(out, "      --upstream-response-timeout DURATION\n")
+	fmt.Fprintf(out, "                       How long to wait for the upstream to accept the\n")
+	fmt.Fprintf(out, "                       connection (default 30s), finish the TLS handshake\n")
+	fmt.Fprintf(out, "                       (default 10s), and send response headers (default\n")
+	fmt.Fprintf(out, "                       forever).  0 means forever.\n")
+	fmt.Fprintf(out, "      --upstream-keepalive DURATION\n")
+	fmt.Fprintf(out, "                       Interval between TCP keep-alive probes (default\n")
+	fmt.Fprintf(out, "                       30s).  0 turns them off.\n")
+	fmt.Fprintf(out, "      --upstream-disable-keepalives\n")
+	fmt.Fprintf(out, "                       Use a new upstream connection for every request.\n")
+	fmt.Fprintf(out, "      --balance round-robin|least-conns|sticky\n")
+	fmt.Fprintf(out, "                       How to spread requests across the instances of a\n")
+	fmt.Fprintf(out, "                       backend given as several URLs, separated by\n")
+	fmt.Fprintf(out, "                       spaces (and quoted, as one argument).\n")
+	fmt.Fprintf(out, "                       Sticky hands out a cookie naming the instance.\n")
+	fmt.Fprintf(out, "      --sticky-cookie NAME\n")
+	fmt.Fprintf(out, "                       The name of that cookie (default gotcha-instance).\n")
+	fmt.Fprintf(out, "      --health-check PATH\n")
+	fmt.Fprintf(out, "                       GET PATH from every instance every so often, and\n")
+	fmt.Fprintf(out, "                       send no requests to those that fail (4xx, 5xx or\n")
+	fmt.Fprintf(out, "                       no answer).\n")
+	fmt.Fprintf(out, "      --health-interval DURATION\n")
+	fmt.Fprintf(out, "                       How often to check (default 10s).\n")
+	fmt.Fprintf(out, "      --eject-after N, --eject-for DURATION\n")
+	fmt.Fprintf(out, "                       Send no requests to an instance for DURATION\n")
+	fmt.Fprintf(out, "                       (default 30s) after N (default 3) connection\n")
+	fmt.Fprintf(out, "                       errors, 502s, 503s or 504s in a row.  0 never.\n")
+	fmt.Fprintf(out, "      --retries N      Try requests again, up to N times, if the upstream\n")
+	fmt.Fprintf(out, "                       can't be reached, drops the connection, or times\n")
+	fmt.Fprintf(out, "                       out.  Only idempotent methods are retried.\n")
+	fmt.Fprintf(out, "      --retry-on STATUS[,STATUS...]\n")
+	fmt.Fprintf(out, "                       Also retry responses with these statuses.\n")
+	fmt.Fprintf(out, "      --retry-any-method\n")
+	fmt.Fprintf(out, "                       Retry POST, PATCH, etc. as well.\n")
+	fmt.Fprintf(out, "      --retry-backoff DURATION, --retry-max-backoff DURATION\n")
+	fmt.Fprintf(out, "                       Wait DURATION (default 100ms) before the first\n")
+	fmt.Fprintf(out, "                       retry, doubling each time, up to the maximum\n")
+	fmt.Fprintf(out, "                       (default 5s), less up to half, at random.\n")
+	fmt.Fprintf(out, "      --resolve HOST:PORT:ADDRESS\n")
+	fmt.Fprintf(out, "                       Connect to ADDRESS for the upstream (or proxy) at\n")
+	fmt.Fprintf(out, "                       HOST:PORT, without looking HOST up.  Can be given\n")
+	fmt.Fprintf(out, "                       more than once.\n")
+	fmt.Fprintf(out, "      --dns-server ADDRESS[:PORT]\n")
+	fmt.Fprintf(out, "                       Look upstream names up with this DNS server,\n")
+	fmt.Fprintf(out, "                       rather than the system's.\n")
+	fmt.Fprintf(out, "      --read-timeout DURATION, --header-timeout DURATION,\n")
+	fmt.Fprintf(out, "      --write-timeout DURATION, --idle-timeout DURATION\n")
+	fmt.Fprintf(out, "                       How long to give clients to send a whole request\n")
+	fmt.Fprintf(out, "                       (default forever), or just its headers (default\n")
+	fmt.Fprintf(out, "                       30s), to take a whole response (default forever),\n")
+	fmt.Fprintf(out, "                       and to send another request on a kept-alive\n")
+	fmt.Fprintf(out, "                       connection (default 2m).  0 means forever.\n")
+	fmt.Fprintf(out, "      --max-conns N, --max-conns-per-ip N\n")
+	fmt.Fprintf(out, "                       Accept at most N client connections at once, in\n")
+	fmt.Fprintf(out, "                       total or from any one IP.  Connections over the\n")
+	fmt.Fprintf(out, "                       limit are closed, and logged.\n")
+	fmt.Fprintf(out, "      --keep-hop-by-hop\n")
+	fmt.Fprintf(out, "                       Pass hop-by-hop headers (Connection, Keep-Alive,\n")
+	fmt.Fprintf(out, "                       TE, Upgrade, etc.) through, as a broken proxy\n")
+	fmt.Fprintf(out, "                       would, instead of stripping them.\n")
+	fmt.Fprintf(out, "      --x-forwarded for,proto,host\n")
+	fmt.Fprintf(out, "                       Add these X-Forwarded-* headers (or all of them)\n")
+	fmt.Fprintf(out, "                       to requests sent upstream.\n")
+	fmt.Fprintf(out, "      --forwarded      Add an RFC 7239 Forwarded header to requests.\n")
+	fmt.Fprintf(out, "      --via            Add a Via header to requests and responses.\n")
+	fmt.Fprintf(out, "      --route-service  Act as a Cloud Foundry route service, sending each\n")
+	fmt.Fprintf(out, "                       request on to its X-CF-Forwarded-Url.  The backend\n")
+	fmt.Fprintf(out, "                       is optional; if given, requests without that header\n")
+	fmt.Fprintf(out, "                       go to it.\n")
+	fmt.Fprintf(out, "      --check-revocation\n")
+	fmt.Fprintf(out, "                       Check whether the upstream's certificates have\n")
+	fmt.Fprintf(out, "                       been revoked (via stapled OCSP, OCSP responders\n")
+	fmt.Fprintf(out, "                       and CRLs), once each response is relayed.\n")
+	fmt.Fprintf(out, "      --keylog FILE    Append the TLS session secrets of both client and\n")
+	fmt.Fprintf(out, "                       upstream connections to FILE, in NSS key log\n")
+	fmt.Fprintf(out, "                       format, for decrypting packet captures with\n")
+	fmt.Fprintf(out, "                       Wireshark.  Defaults to $SSLKEYLOGFILE.\n")
+	fmt.Fprintf(out, "      --pcap FILE      Write every exchange to FILE (pcapng), as plaintext\n")
+	fmt.Fprintf(out, "                       TCP streams between the real client, gotcha and\n")
+	fmt.Fprintf(out, "                       upstream addresses, for Wireshark or tshark.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Options that take a list can be given more than once, or given several\n")
+	fmt.Fprintf(out, "values at a time, separated by commas or spaces.  Lists of files are the\n")
+	fmt.Fprintf(out, "exception: they are separated by colons, like $PATH, in the environment.\n")
+	fmt.Fprintf(out, "So are backends: URLs can have commas in them, so several backends are\n")
+	fmt.Fprintf(out, "separated by spaces only.\n")
 }
 
-type Cert struct {
-	RawCertificate *x509.Certificate
-	RawKey         *rsa.PrivateKey
+// banner prints the line that starts each block of an exchange dump,
+// with the exchange ID in it, padded out to a fixed width.
+func banner(out io.Writer, marker, title string, id uint64) {
+	s := fmt.Sprintf("%s  %s #%d  ", marker, title, id)
+	fmt.Fprintf(out, "\n\n%s%s\n", s, strings.Repeat("=", 57-len(s)))
+}
 
-	Certificate string
-	Key         string
+// dumpClientConnection prints the addresses of either end of the
+// connection that a request came in on.
+func dumpClientConnection(out io.Writer, req *http.Request) {
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		fmt.Fprintf(out, "@C{client connection:} %s -> %s\n\n", req.RemoteAddr, local)
+	} else {
+		fmt.Fprintf(out, "@C{client connection:} %s\n\n", req.RemoteAddr)
+	}
 }
 
-func (ca *Cert) Sign(cert *Cert) error {
-	raw, err := x509.CreateCertificate(rand.Reader, cert.RawCertificate, ca.RawCertificate, cert.RawKey.Public(), ca.RawKey)
-	if err != nil {
-		return err
+func setupTLS(server *http.Server, opt *Opt, clientAuth tls.ClientAuthType, clientCAs *x509.CertPool, constraints tlsConstraints) {
+	server.TLSConfig = &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		ClientAuth: clientAuth,
+		ClientCAs:  clientCAs,
+	}
+	constraints.Apply(server.TLSConfig)
+	if s := constraints.String(); s != "" {
+		fmt.Fprintf(os.Stderr, "constraining client TLS to %s\n", s)
 	}
 
-	cert.Certificate = string(pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: raw,
-	}))
+	if len(opt.TLSCert) > 0 {
+		store, err := newCertStore(opt.TLSCert, opt.TLSKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load certificate: %s\n", err)
+			os.Exit(1)
+		}
+		for _, src := range store.sources {
+			fmt.Fprintf(os.Stderr, "presenting certificate @C{%s}: %s\n", src.certFile, src.describe())
+		}
+		go store.Watch(5 * time.Second)
+		server.TLSConfig.GetCertificate = store.GetCertificate
+		return
+	}
 
-	return nil
-}
+	var ca *Cert
+	generated := true
+	if opt.EphemeralCA {
+		var err error
+		if ca, err = newCA(opt.KeyType, opt.Signature); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	} else {
+		ca, generated = mustLoadOrInitCA(opt.KeyType, opt.Signature)
+	}
 
-func certificate(name string, serial int, ttl time.Duration) (*Cert, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, err
-	}
-
-	cert := &x509.Certificate{
-		SignatureAlgorithm:    x509.SHA512WithRSA, /* FIXME: hard-coded */
-		PublicKeyAlgorithm:    x509.RSA,
-		Subject:               pkix.Name{CommonName: name},
-		DNSNames:              []string{name},
-		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
-		BasicConstraintsValid: true,
-		IsCA:         true,
-		MaxPathLen:   1,
-		SerialNumber: big.NewInt(1),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(ttl),
-	}
-
-	pKey := string(pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}))
-
-	return &Cert{
-		RawCertificate: cert,
-		RawKey:         key,
-
-		//	Certificate: pCert,
-		Key: pKey,
-	}, nil
-}
-func generateCA() error {
-	GotchaCAPath := os.Getenv("HOME") + "/.gotcha"
-	fmt.Printf("gotcha CA folder does not exist ... generating $HOME/.gotcha folder to use for TLS files\n")
-	err := os.MkdirAll(GotchaCAPath, os.ModePerm)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create gotcha ca folder at $HOME/.gotcha: %s\n", err)
+	names := splitList(opt.SANs)
+	if len(names) == 0 {
+		names = bindNames(server.Addr)
 	}
 
-	ca, err := certificate("gotcha-ca", 1, 100*365*24*time.Hour)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to generate a CA certificate: %s\n", err)
+	dir := ""
+	if !opt.EphemeralCA && caDir() != "" {
+		dir = leafCacheDir()
+	}
+	cache := newLeafCache(ca, dir, 90*24*time.Hour, opt.KeyType, opt.Signature)
+	if _, err := cache.Get(names); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 
-	if err := ca.Sign(ca); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to sign CA certificate: %s\n", err)
-		os.Exit(1)
+	switch {
+	case opt.EphemeralCA || caDir() == "":
+		fmt.Fprintf(os.Stderr, "signing with an ephemeral CA (fingerprint %s):\n%s", fingerprint(ca.RawCertificate), ca.Certificate)
+	case generated:
+		fmt.Fprintf(os.Stderr, "signing with a new CA, generated in @C{%s} (fingerprint %s):\n%s", caDir(), fingerprint(ca.RawCertificate), ca.Certificate)
+	default:
+		fmt.Fprintf(os.Stderr, "signing with CA @C{%s} (fingerprint %s)\n", caCertPath(), fingerprint(ca.RawCertificate))
+		fmt.Fprintf(os.Stderr, "run `gotcha ca export` for a copy of the CA certificate\n")
 	}
-	f, err := os.Create(GotchaCAPath + "/ca_cert.pem")
-	if err != nil {
-		return err
+	fmt.Fprintf(os.Stderr, "presenting a certificate for %s\n", strings.Join(names, ", "))
+	server.TLSConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cache.Get(names)
 	}
-	f.WriteString(ca.Certificate)
-	f.Close()
+}
 
-	f, err = os.Create(GotchaCAPath + "/ca_key.pem")
-	if err != nil {
-		return err
+func main() {
+	var opt Opt
+
+	envBool("SSL_SKIP_VERIFY", &opt.SkipVerify)
+	opt.CAFile = envList("GOTCHA_CA_FILE")
+	opt.CAPath = os.Getenv("GOTCHA_CA_PATH")
+	opt.CACerts = os.Getenv("GOTCHA_CA_CERTS")
+	opt.ClientCert = os.Getenv("GOTCHA_CLIENT_CERT")
+	opt.ClientKey = os.Getenv("GOTCHA_CLIENT_KEY")
+	opt.ClientPassword = os.Getenv("GOTCHA_CLIENT_PASSWORD")
+	opt.ClientCertFor = envFields("GOTCHA_CLIENT_CERT_FOR")
+	opt.ClientAuth = os.Getenv("GOTCHA_CLIENT_AUTH")
+	opt.ClientCA = envList("GOTCHA_CLIENT_CA")
+	opt.CADir = os.Getenv("GOTCHA_CA_DIR")
+	opt.CAPassphrase = os.Getenv("GOTCHA_CA_PASSPHRASE")
+	envBool("GOTCHA_EPHEMERAL_CA", &opt.EphemeralCA)
+	opt.TLSCert = envList("GOTCHA_TLS_CERT")
+	opt.TLSKey = envList("GOTCHA_TLS_KEY")
+	opt.KeyType = os.Getenv("GOTCHA_KEY_TYPE")
+	opt.Signature = os.Getenv("GOTCHA_SIGNATURE")
+	opt.SANs = envFields("GOTCHA_SANS")
+	opt.UpstreamTLSMin = os.Getenv("GOTCHA_UPSTREAM_TLS_MIN")
+	opt.UpstreamTLSMax = os.Getenv("GOTCHA_UPSTREAM_TLS_MAX")
+	opt.UpstreamCiphers = envFields("GOTCHA_UPSTREAM_CIPHERS")
+	opt.UpstreamCurves = envFields("GOTCHA_UPSTREAM_CURVES")
+	opt.SNI = os.Getenv("GOTCHA_SNI")
+	opt.TLSMin = os.Getenv("GOTCHA_TLS_MIN")
+	opt.TLSMax = os.Getenv("GOTCHA_TLS_MAX")
+	opt.TLSCiphers = envFields("GOTCHA_TLS_CIPHERS")
+	opt.TLSCurves = envFields("GOTCHA_TLS_CURVES")
+	envBool("GOTCHA_CHECK_REVOCATION", &opt.CheckRevocation)
+	envBool("GOTCHA_ROUTE_SERVICE", &opt.RouteService)
+	opt.KeyLog = os.Getenv("SSLKEYLOGFILE")
+	opt.Pcap = os.Getenv("GOTCHA_PCAP")
+
+	envBool("GOTCHA_REWRITE_URLS", &opt.RewriteURLs)
+	envBool("GOTCHA_SAME_HOST_REDIRECTS", &opt.SameHostRedirects)
+	envBool("GOTCHA_REDIRECT_KEEP_METHOD", &opt.RedirectKeepMethod)
+	opt.XForwarded = envFields("GOTCHA_X_FORWARDED")
+	opt.HostHeader = os.Getenv("GOTCHA_HOST_HEADER")
+	opt.Resolve = envFields("GOTCHA_RESOLVE")
+	opt.Balance = os.Getenv("GOTCHA_BALANCE")
+	opt.RetryOn = envFields("GOTCHA_RETRY_ON")
+	opt.HealthCheck = os.Getenv("GOTCHA_HEALTH_CHECK")
+	opt.DNSServer = os.Getenv("GOTCHA_DNS_SERVER")
+	envBool("GOTCHA_REDIRECT", &opt.Redirect)
+	envBool("GOTCHA_KEEP_HOP_BY_HOP", &opt.KeepHopByHop)
+	envBool("GOTCHA_FORWARDED", &opt.Forwarded)
+	envBool("GOTCHA_VIA", &opt.Via)
+	envBool("GOTCHA_PRESERVE_HOST", &opt.PreserveHost)
+	envBool("GOTCHA_RETRY_ANY_METHOD", &opt.RetryAnyMethod)
+	opt.RedirectForward = envFields("GOTCHA_REDIRECT_FORWARD")
+	opt.RedirectStrip = envFields("GOTCHA_REDIRECT_STRIP")
+
+	opt.MaxRedirects = 10
+	opt.StickyCookie = "gotcha-instance"
+	opt.HealthInterval = "10s"
+	opt.EjectAfter = 3
+	opt.EjectFor = "30s"
+	opt.RetryBackoff = "100ms"
+	opt.RetryMaxBackoff = "5s"
+	opt.UpstreamMaxIdle = 100
+	opt.UpstreamMaxIdlePerHost = 10
+	opt.UpstreamIdleTimeout = "90s"
+	opt.UpstreamDialTimeout = "30s"
+	opt.UpstreamTLSTimeout = "10s"
+	opt.UpstreamKeepAlive = "30s"
+	opt.HeaderTimeout = "30s"
+	opt.IdleTimeout = "2m"
+	for _, env := range []struct {
+		name string
+		into *int
+	}{
+		{"GOTCHA_UPSTREAM_MAX_IDLE", &opt.UpstreamMaxIdle},
+		{"GOTCHA_UPSTREAM_MAX_IDLE_PER_HOST", &opt.UpstreamMaxIdlePerHost},
+		{"GOTCHA_UPSTREAM_MAX_CONNS", &opt.UpstreamMaxConns},
+		{"GOTCHA_MAX_CONNS", &opt.MaxConns},
+		{"GOTCHA_MAX_CONNS_PER_IP", &opt.MaxConnsPerIP},
+		{"GOTCHA_MAX_REDIRECTS", &opt.MaxRedirects},
+		{"GOTCHA_EJECT_AFTER", &opt.EjectAfter},
+		{"GOTCHA_RETRIES", &opt.Retries},
+	} {
+		if err := envInt(env.name, env.into); err != nil {
+			fmt.Fprintf(os.Stderr, "@R{!!! %s}\n", err)
+			os.Exit(1)
+		}
 	}
-	f.WriteString(ca.Key)
-	f.Close()
-	return nil
-}
-func loadCA() (*Cert, error) {
-	GotchaCAPath := os.Getenv("HOME") + "/.gotcha"
-	if _, err := os.Stat(GotchaCAPath); os.IsNotExist(err) {
-		//path does not exist, so generate the files to be loaded
-		err := generateCA()
-		if err != nil {
-			return nil, err
+	for _, env := range []struct {
+		name string
+		into *string
+	}{
+		{"GOTCHA_UPSTREAM_IDLE_TIMEOUT", &opt.UpstreamIdleTimeout},
+		{"GOTCHA_UPSTREAM_DIAL_TIMEOUT", &opt.UpstreamDialTimeout},
+		{"GOTCHA_UPSTREAM_TLS_TIMEOUT", &opt.UpstreamTLSTimeout},
+		{"GOTCHA_UPSTREAM_RESPONSE_TIMEOUT", &opt.UpstreamResponseTimeout},
+		{"GOTCHA_UPSTREAM_KEEPALIVE", &opt.UpstreamKeepAlive},
+		{"GOTCHA_READ_TIMEOUT", &opt.ReadTimeout},
+		{"GOTCHA_HEADER_TIMEOUT", &opt.HeaderTimeout},
+		{"GOTCHA_WRITE_TIMEOUT", &opt.WriteTimeout},
+		{"GOTCHA_IDLE_TIMEOUT", &opt.IdleTimeout},
+		{"GOTCHA_STICKY_COOKIE", &opt.StickyCookie},
+		{"GOTCHA_HEALTH_INTERVAL", &opt.HealthInterval},
+		{"GOTCHA_EJECT_FOR", &opt.EjectFor},
+		{"GOTCHA_RETRY_BACKOFF", &opt.RetryBackoff},
+		{"GOTCHA_RETRY_MAX_BACKOFF", &opt.RetryMaxBackoff},
+	} {
+		if v := os.Getenv(env.name); v != "" {
+			*env.into = v
 		}
 	}
-	fmt.Printf("Using cached CA certificate located at: %s/ca_cert.pem\n", GotchaCAPath)
-	cert, err := ioutil.ReadFile(GotchaCAPath + "/ca_cert.pem")
+	envBool("GOTCHA_UPSTREAM_DISABLE_KEEPALIVES", &opt.UpstreamDisableKeepAlives)
+
+	opt.CA.Issue.Days = 90
+
+	command, args, err := cli.Parse(&opt)
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "@R{!!! %s}\n", err)
+		os.Exit(1)
 	}
-	key, err := ioutil.ReadFile(GotchaCAPath + "/ca_key.pem")
-	if err != nil {
-		return nil, err
+
+	if opt.Version {
+		if Version == "" {
+			fmt.Printf("gotcha (development)\n")
+		} else {
+			fmt.Printf("gotcha v%s\n", Version)
+		}
+		os.Exit(0)
 	}
-	certBlock, _ := pem.Decode(cert)
-	if certBlock == nil {
-		return nil, errors.New("Failed to decode ca certificate")
+
+	if opt.Help {
+		if strings.HasPrefix(command, "ca") {
+			caUsage(os.Stdout)
+		} else {
+			usage(os.Stdout)
+		}
+		return
 	}
-	keyBlock, _ := pem.Decode(key)
-	if keyBlock == nil {
-		return nil, errors.New("Failed to decode ca private key")
+
+	CADir = opt.CADir
+	CAPassphrase = opt.CAPassphrase
+
+	if strings.HasPrefix(command, "ca") {
+		runCA(&opt, command, args)
+		return
 	}
-	rawKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-	if err != nil {
-		return nil, err
+
+	if len(opt.TLSCert) > 0 || opt.EphemeralCA {
+		opt.TLS = true
 	}
-	rawCert, err := x509.ParseCertificate(certBlock.Bytes)
-	if err != nil {
-		return nil, err
+
+	if len(args) > 2 {
+		usage(os.Stderr)
+		os.Exit(1)
 	}
 
-	return &Cert{
-		RawCertificate: rawCert,
-		RawKey:         rawKey,
+	backend := os.Getenv("GOTCHA_BACKEND")
+	if len(args) >= 1 {
+		backend = args[0]
+	}
 
-		Certificate: string(cert),
-		Key:         string(key),
-	}, nil
-}
+	if backend == "" && !opt.RouteService {
+		fmt.Fprintf(os.Stderr, "No backend host specified, and no $GOTCHA_BACKEND environment variable set\n\n"+
+			"If you are deploying gotcha as a Cloud Foundry application, don't forget to `cf set-env"+
+			" appname GOTCHA_BACKEND https://host/url'\n\n")
+		os.Exit(1)
+	}
+
+	var pool *upstreamPool
+	if backend != "" {
+		pool, err = parseUpstreamPool(backend, &opt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if pool.Len() == 1 {
+			fmt.Fprintf(os.Stderr, "targeting %s\n", pool.instances[0].url)
+		} else {
+			for _, i := range pool.instances {
+				fmt.Fprintf(os.Stderr, "targeting %s (instance #%d)\n", i.url, i.id)
+			}
+			fmt.Fprintf(os.Stderr, "balancing requests by %s\n", pool.balance)
+		}
+	}
+	if opt.RouteService {
+		fmt.Fprintf(os.Stderr, "acting as a Cloud Foundry route service\n")
+	}
 
-func setupTLS(server *http.Server) {
-	ca, err := loadCA()
+	roots, err := trustedCAs(opt.CAFile, opt.CAPath, opt.CACerts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to load or generate a CA: %s\n", err)
+		fmt.Fprintf(os.Stderr, "failed to load trusted CA certificates: %s\n", err)
 		os.Exit(1)
 	}
 
-	cert, err := certificate("gotcha", 2, 10*365*24*time.Hour)
+	clientCerts, err := loadClientCertificates(&opt)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to generate a certificate: %s\n", err)
+		fmt.Fprintf(os.Stderr, "failed to load client certificate: %s\n", err)
 		os.Exit(1)
 	}
+	clientCerts.Dump(os.Stderr)
 
-	if err := ca.Sign(cert); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to sign certificate: %s\n", err)
+	upstreamTLS, err := parseTLSConstraints(opt.UpstreamTLSMin, opt.UpstreamTLSMax, opt.UpstreamCiphers, opt.UpstreamCurves)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
+	if s := upstreamTLS.String(); s != "" {
+		fmt.Fprintf(os.Stderr, "constraining upstream TLS to %s\n", s)
+	}
+	if opt.SNI != "" {
+		fmt.Fprintf(os.Stderr, "sending server name (SNI) %s to upstream\n", opt.SNI)
+	}
 
-	pair, err := tls.X509KeyPair([]byte(cert.Certificate), []byte(cert.Key))
+	transportOpts, err := parseTransportOptions(&opt)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to parse certificate: %s\n", err)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("@G{CA Certificate:}\n%s\n\n", ca.Certificate)
-	server.TLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{pair},
-		NextProtos:   []string{"http/1.1"},
+	for from, to := range transportOpts.resolve {
+		fmt.Fprintf(os.Stderr, "connecting to %s for %s\n", to, from)
 	}
-}
-func main() {
-	var opt Opt
-
-	verifyStr := strings.ToLower(os.Getenv("SSL_SKIP_VERIFY"))
-	if verifyStr != "" && verifyStr != "no" && verifyStr != "false" && verifyStr != "0" {
-		opt.SkipVerify = true
+	if transportOpts.dnsServer != "" {
+		fmt.Fprintf(os.Stderr, "looking up upstream names with DNS server %s\n", transportOpts.dnsServer)
+	}
+	forwarding, err := parseForwardingPolicy(&opt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
 
-	_, args, err := cli.Parse(&opt)
+	retries, err := parseRetryPolicy(&opt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 
-	if opt.Version {
-		if Version == "" {
-			fmt.Printf("gotcha (development)\n")
-		} else {
-			fmt.Printf("gotcha v%s\n", Version)
-		}
-		os.Exit(0)
+	listenerOpts, err := parseListenerOptions(&opt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
 
-	if opt.Help {
-		usage(os.Stdout)
-		return
+	upstreamConfig := &tls.Config{
+		InsecureSkipVerify: opt.SkipVerify,
+		RootCAs:            roots,
+		ServerName:         opt.SNI,
+
+		GetClientCertificate: presentClientCertificate(clientCerts),
 	}
+	upstreamTLS.Apply(upstreamConfig)
 
-	if len(args) > 2 {
-		usage(os.Stderr)
+	listenerTLS, err := parseTLSConstraints(opt.TLSMin, opt.TLSMax, opt.TLSCiphers, opt.TLSCurves)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 
-	backend := os.Getenv("GOTCHA_BACKEND")
-	if len(args) >= 1 {
-		backend = args[0]
+	var clientCAs *x509.CertPool
+	if len(opt.ClientCA) > 0 {
+		clientCAs = x509.NewCertPool()
+		for _, file := range opt.ClientCA {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read client CA certificate: %s\n", err)
+				os.Exit(1)
+			}
+			if !clientCAs.AppendCertsFromPEM(b) {
+				fmt.Fprintf(os.Stderr, "failed to read client CA certificate: no PEM certificates found in %s\n", file)
+				os.Exit(1)
+			}
+		}
+	}
+	clientAuth, err := clientAuthType(opt.ClientAuth, clientCAs != nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
 
-	if backend == "" {
-		fmt.Fprintf(os.Stderr, "No backend host specified, and no $GOTCHA_BACKEND environment variable set\n\n"+
-			"If you are deploying gotcha as a Cloud Foundry application, don't forget to `cf set-env"+
-			" appname GOTCHA_BACKEND https://host/url'\n\n")
+	keylog, err := openKeyLog(opt.KeyLog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open key log: %s\n", err)
 		os.Exit(1)
 	}
+	if keylog != nil {
+		fmt.Fprintf(os.Stderr, "logging TLS session secrets to @C{%s}\n", opt.KeyLog)
+	}
 
-	target, err := url.Parse(backend)
+	pcap, err := openPcap(opt.Pcap)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to parse target '%s': %s\n", args[0], err)
+		fmt.Fprintf(os.Stderr, "failed to open capture file: %s\n", err)
 		os.Exit(1)
 	}
-	fmt.Fprintf(os.Stderr, "targeting %s\n", target)
+	if pcap != nil {
+		fmt.Fprintf(os.Stderr, "capturing exchanges to @C{%s}\n", opt.Pcap)
+	}
 
 	bind := ":3128"
 	if os.Getenv("PORT") != "" {
@@ -277,7 +730,9 @@ func main() {
 		}
 	}
 	fmt.Fprintf(os.Stderr, "binding %s\n", bind)
-	if !opt.Redirect {
+	if !opt.Redirect && opt.RouteService {
+		fmt.Fprintf(os.Stderr, "redirects will be followed, except for route service requests\n")
+	} else if !opt.Redirect {
 		fmt.Fprintf(os.Stderr, "redirects will be followed\n")
 	} else {
 		fmt.Fprintf(os.Stderr, "redirects will be returned\n")
@@ -286,18 +741,84 @@ func main() {
 	server := &http.Server{
 		Addr: bind,
 	}
+	listenerOpts.Apply(server)
+
+	transport := newUpstreamTransport(upstreamConfig, keylog, transportOpts)
+	var revocation *revocationChecker
+	if opt.CheckRevocation {
+		revocation = newRevocationChecker(transport, roots)
+		fmt.Fprintf(os.Stderr, "checking upstream certificates for revocation\n")
+	}
+	redirects := newRedirectPolicy(&opt)
+	go pool.HealthCheck(transport)
 
+	var exchanges uint64
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		id := atomic.AddUint64(&exchanges, 1)
+		received := time.Now()
+		var body []byte
+
+		/* answer the client ourselves, when there is no upstream
+		   response to relay */
+		fail := func(status int, message string) {
+			w.WriteHeader(status)
+			io.WriteString(w, message)
+			if err := pcap.Failed(id, req, received, body, status, w.Header(), []byte(message)); err != nil {
+				fmt.Fprintf(os.Stderr, "@Y{failed to write to capture file:} %s\n", err)
+			}
+		}
+
 		end, err := url.Parse(req.URL.String())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to parse requested uri '%s': %s\n", req.URL, err)
-			w.WriteHeader(599)
+			fail(599, "")
 			return
 		}
 		wanted := end.Host
-		end.Host = target.Host
-		end.Scheme = target.Scheme
+		var rewriter *originRewriter
+		var instance *upstreamInstance
+		var picked string
+		routed := opt.RouteService && (req.Header.Get(cfForwardedURL) != "" || pool == nil)
+		if routed {
+			if end, err = routeServiceURL(req); err != nil {
+				fmt.Fprintf(os.Stderr, "@R{%s}\n", err)
+				fail(400, err.Error()+"\n")
+				return
+			}
+			wanted = ""
+		} else {
+			instance, picked = pool.Pick(req, nil)
+			defer func() { pool.Release(instance) }()
+			if opt.RewriteURLs {
+				rewriter = newOriginRewriter(instance.url, opt.TLS, req.Host)
+			}
+			end.Host = instance.url.Host
+			end.Scheme = instance.url.Scheme
+		}
+
+		if req.Body != nil {
+			if pcap != nil || retries.Enabled() {
+				if body, err = ioutil.ReadAll(req.Body); err == nil {
+					req.Body = ioutil.NopCloser(bytes.NewReader(body))
+				}
+			} else if !opt.Redirect && !routed && req.ContentLength <= redirectBodyLimit {
+				/* only redirects that keep the body need it again,
+				   so don't hold on to big ones for them */
+				body, req.Body, err = bufferSmallBody(req.Body, redirectBodyLimit)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read request body: %s\n", err)
+				fail(599, "")
+				return
+			}
+		}
 		b2b, err := http.NewRequest(req.Method, end.String(), req.Body)
+		if body != nil {
+			// so that the body can be sent again, if redirected or retried
+			b2b.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
 		for header, values := range req.Header {
 			if header == "Referer" && opt.Redirect && !opt.KeepReferer {
 				continue
@@ -307,10 +828,38 @@ func main() {
 			}
 		}
 
+		if opt.HostHeader != "" {
+			b2b.Host = opt.HostHeader
+		} else if opt.PreserveHost {
+			b2b.Host = req.Host
+		}
+		forwarding.Request(b2b, req)
+		pool.Unstick(b2b)
+		if opt.ForwardClientCert {
+			forwardClientCertificate(b2b, req.TLS)
+		}
+
 		b2b.ContentLength = req.ContentLength
 		b2b.TransferEncoding = req.TransferEncoding
 
-		fmt.Fprintf(os.Stderr, "\n\n>>>  REQUEST  ===========================================\n")
+		trace := &exchangeTrace{id: id}
+		if pool.Len() > 1 && instance != nil {
+			trace.instance = instance.String()
+		}
+		b2b = b2b.WithContext(trace.Context(b2b.Context()))
+
+		banner(os.Stderr, ">>>", "REQUEST", id)
+		dumpClientConnection(os.Stderr, req)
+		if opt.RouteService {
+			dumpRouteService(os.Stderr, req)
+		}
+		dumpClientCertificates(os.Stderr, req.TLS)
+		if instance != nil {
+			pool.Dump(os.Stderr, instance, picked)
+		}
+		if opt.PreserveHost || opt.HostHeader != "" || opt.SNI != "" {
+			dumpUpstreamNames(os.Stderr, b2b, &opt)
+		}
 		dumpRequest(os.Stderr, b2b, opt.OnlyHeaders)
 
 		client := &http.Client{
@@ -318,40 +867,74 @@ func main() {
 				if opt.Redirect {
 					return http.ErrUseLastResponse
 				}
-
-				if len(via) > 10 {
-					return fmt.Errorf("stopped after 10 redirects")
-				}
-				for header, values := range via[0].Header {
-					for _, value := range values {
-						req.Header.Add(header, value)
+				if routed {
+					/* the signature is only good for the forwarded URL,
+					   so the client has to follow it, through the gorouter */
+					banner(os.Stderr, "@@@", "REDIRECT", id)
+					if req.Response != nil {
+						fmt.Fprintf(os.Stderr, "@C{redirect:}        %s from @Y{%s}\n", req.Response.Status, via[len(via)-1].URL)
 					}
+					fmt.Fprintf(os.Stderr, "                 to @Y{%s}\n", req.URL)
+					fmt.Fprintf(os.Stderr, "@C{decision:}        @Y{not following}; route service requests hand redirects\n")
+					fmt.Fprintf(os.Stderr, "                 back to the client\n\n")
+					return http.ErrUseLastResponse
 				}
 
-				fmt.Fprintf(os.Stderr, "\n\n@@@  REDIRECT ===========================================\n")
+				banner(os.Stderr, "@@@", "REDIRECT", id)
+				if err := redirects.Follow(os.Stderr, req, via); err != nil {
+					return err
+				}
 				dumpRequest(os.Stderr, req, opt.OnlyHeaders)
 				return nil
 			},
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: opt.SkipVerify,
-				},
-				Proxy: http.ProxyFromEnvironment,
-			},
+			Transport: transport,
 		}
 		fmt.Fprintf(os.Stderr, "\n")
 		var res *http.Response
-		timing("relay request", func() {
-			res, err = client.Do(b2b)
+		var tried []*upstreamInstance
+		var took time.Duration
+		res, took, err = retries.Do(os.Stderr, id, client, b2b, func(res *http.Response, err error) {
+			pool.Report(instance, err, res)
+		}, func(r *http.Request) string {
+			/* try somewhere else, if there is anywhere else */
+			if instance == nil || pool.Len() < 2 {
+				return ""
+			}
+			tried = append(tried, instance)
+			pool.Release(instance)
+			instance, picked = pool.Pick(req, tried)
+			if opt.HostHeader == "" && !opt.PreserveHost {
+				r.Host = instance.url.Host
+			}
+			r.URL.Host, r.URL.Scheme = instance.url.Host, instance.url.Scheme
+			trace.instance = instance.String()
+			if opt.RewriteURLs {
+				rewriter = newOriginRewriter(instance.url, opt.TLS, req.Host)
+			}
+			return fmt.Sprintf("%s (%s)", instance, picked)
 		})
+		tookTime("relay request", took)
 
 		if err != nil {
+			if why := dumpTLSFailure(os.Stderr, err); why != "" {
+				fail(599, "upstream certificate verification failed: "+why+"\n")
+				return
+			}
 			fmt.Fprintf(os.Stderr, "failed to read response: %s\n", err)
-			w.WriteHeader(599)
+			fail(599, "upstream request failed: "+err.Error()+"\n")
 			return
 		}
 
-		fmt.Fprintf(os.Stderr, "\n\n<<<  RESPONSE  ==========================================\n")
+		var tlsinfo bytes.Buffer
+		if trace.DumpTLS(&tlsinfo, roots, opt.SkipVerify) {
+			banner(os.Stderr, "***", "TLS", id)
+			io.Copy(os.Stderr, &tlsinfo)
+		}
+
+		defer res.Body.Close()
+		res.Body = trace.Body(res.Body)
+
+		banner(os.Stderr, "<<<", "RESPONSE", id)
 		dumpResponse(os.Stderr, res, opt.OnlyHeaders)
 
 		fmt.Fprintf(os.Stderr, "\n")
@@ -362,12 +945,16 @@ func main() {
 
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to read body: %s\n", err)
-			w.WriteHeader(599)
+			fail(599, "")
 			return
 		}
+
+		banner(os.Stderr, "###", "TIMING", id)
+		trace.Dump(os.Stderr)
+		fmt.Fprintf(os.Stderr, "\n")
 		for header, values := range res.Header {
 			for _, value := range values {
-				if header == "Location" && opt.Redirect {
+				if header == "Location" && opt.Redirect && wanted != "" {
 					u, err := url.Parse(value)
 					if err == nil {
 						if opt.TLS {
@@ -382,17 +969,44 @@ func main() {
 				w.Header().Add(header, value)
 			}
 		}
+		forwarding.Response(w.Header(), res)
+		pool.Stick(w.Header(), req, instance)
+		sent := rewriter.Rewrite(os.Stderr, w.Header(), b)
 
 		timing("relay response", func() {
 			w.WriteHeader(res.StatusCode)
-			w.Write(b)
+			w.Write(sent)
 		})
+
+		if err := pcap.Exchange(id, req, received, body, res, b, w.Header(), sent, trace); err != nil {
+			fmt.Fprintf(os.Stderr, "@Y{failed to write to capture file:} %s\n", err)
+		}
+
+		if state := trace.TLS(); revocation != nil && state != nil {
+			/* OCSP responders and CRLs can be slow (or not there at all),
+			   so the client doesn't wait on them, and neither do other
+			   exchanges */
+			go func() {
+				var b bytes.Buffer
+				banner(&b, "***", "REVOCATION", id)
+				revocation.Dump(&b, state)
+				io.Copy(os.Stderr, &b)
+			}()
+		}
 	})
+
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to bind %s: %s\n", bind, err)
+		os.Exit(1)
+	}
+	ln := newClientListener(l, listenerOpts)
 	if opt.TLS {
-		setupTLS(server)
-		server.ListenAndServeTLS("", "")
+		setupTLS(server, &opt, clientAuth, clientCAs, listenerTLS)
+		keylog.Listen(server.TLSConfig)
+		server.ServeTLS(ln, "", "")
 	} else {
-		server.ListenAndServe()
+		server.Serve(ln)
 	}
 }
 
@@ -454,6 +1068,30 @@ func dumpResponse(out io.Writer, r *http.Response, onlyh bool) {
 	}
 }
 
+// dumpUpstreamNames prints where a request is really going, alongside
+// the names it is going there under (the Host header, and for HTTPS,
+// the server name sent in the TLS handshake), when those have been
+// changed from the upstream's own.
+func dumpUpstreamNames(out io.Writer, r *http.Request, opt *Opt) {
+	fmt.Fprintf(out, "@C{upstream address:}   %s\n", r.URL.Host)
+	switch {
+	case opt.HostHeader != "":
+		fmt.Fprintf(out, "@C{host header:}        @Y{%s} (--host-header)\n", r.Host)
+	case opt.PreserveHost:
+		fmt.Fprintf(out, "@C{host header:}        @Y{%s} (the client's)\n", r.Host)
+	default:
+		fmt.Fprintf(out, "@C{host header:}        %s (the upstream's)\n", r.URL.Host)
+	}
+	if r.URL.Scheme == "https" {
+		if opt.SNI != "" {
+			fmt.Fprintf(out, "@C{server name (sni):}  @Y{%s} (--sni)\n", opt.SNI)
+		} else {
+			fmt.Fprintf(out, "@C{server name (sni):}  %s (the upstream's)\n", r.URL.Hostname())
+		}
+	}
+	fmt.Fprintf(out, "\n")
+}
+
 func dumpRequest(out io.Writer, r *http.Request, onlyh bool) {
 	uri := r.RequestURI
 	if uri == "" {
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pcapFile is a pcapng capture of the exchanges that gotcha relays,
+// as Wireshark would have seen them if there were no TLS involved.
+// Each exchange is written out as two synthetic TCP streams, one for
+// the client's connection to gotcha and one for gotcha's connection
+// to the upstream, with the real addresses and (approximately) real
+// timestamps, handshakes and all.  The packets are raw IP (there is
+// no link layer to speak of), and the HTTP messages in them are put
+// back together from what gotcha saw, so they are close to what was
+// sent, but not byte-for-byte.
+type pcapFile struct {
+	lock sync.Mutex
+	out  io.Writer
+	ipid uint16
+}
+
+const (
+	pcapLinkTypeRaw = 101
+	pcapMSS         = 1460
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+func openPcap(path string) (*pcapFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pcapFile{out: f}
+
+	var shb bytes.Buffer
+	binary.Write(&shb, binary.LittleEndian, uint32(0x1a2b3c4d)) // byte-order magic
+	binary.Write(&shb, binary.LittleEndian, uint16(1))          // major version
+	binary.Write(&shb, binary.LittleEndian, uint16(0))          // minor version
+	binary.Write(&shb, binary.LittleEndian, int64(-1))          // section length (unknown)
+	pcapOption(&shb, 4, "gotcha")                               // shb_userappl
+	pcapOption(&shb, 0, "")
+	if err := p.block(0x0a0d0d0a, shb.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var idb bytes.Buffer
+	binary.Write(&idb, binary.LittleEndian, uint16(pcapLinkTypeRaw))
+	binary.Write(&idb, binary.LittleEndian, uint16(0)) // reserved
+	binary.Write(&idb, binary.LittleEndian, uint32(0)) // snap length (unlimited)
+	if err := p.block(1, idb.Bytes()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func pcapOption(out *bytes.Buffer, code uint16, value string) {
+	binary.Write(out, binary.LittleEndian, code)
+	binary.Write(out, binary.LittleEndian, uint16(len(value)))
+	out.WriteString(value)
+	out.Write(make([]byte, pad4(len(value))))
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+func (p *pcapFile) block(typ uint32, body []byte) error {
+	var b bytes.Buffer
+	size := uint32(12 + len(body) + pad4(len(body)))
+	binary.Write(&b, binary.LittleEndian, typ)
+	binary.Write(&b, binary.LittleEndian, size)
+	b.Write(body)
+	b.Write(make([]byte, pad4(len(body))))
+	binary.Write(&b, binary.LittleEndian, size)
+	_, err := p.out.Write(b.Bytes())
+	return err
+}
+
+type pcapPacket struct {
+	at      time.Time
+	data    []byte
+	comment string
+}
+
+func (p *pcapFile) packet(pkt pcapPacket) error {
+	var epb bytes.Buffer
+	us := uint64(pkt.at.UnixNano() / 1000)
+	binary.Write(&epb, binary.LittleEndian, uint32(0)) // interface
+	binary.Write(&epb, binary.LittleEndian, uint32(us>>32))
+	binary.Write(&epb, binary.LittleEndian, uint32(us))
+	binary.Write(&epb, binary.LittleEndian, uint32(len(pkt.data)))
+	binary.Write(&epb, binary.LittleEndian, uint32(len(pkt.data)))
+	epb.Write(pkt.data)
+	epb.Write(make([]byte, pad4(len(pkt.data))))
+	if pkt.comment != "" {
+		pcapOption(&epb, 1, pkt.comment) // opt_comment
+		pcapOption(&epb, 0, "")
+	}
+	return p.block(6, epb.Bytes())
+}
+
+// pcapStream is one side of an exchange: a connection from client to
+// server, carrying one request and its response.
+type pcapStream struct {
+	comment        string
+	client, server string
+
+	opened    time.Time
+	requested time.Time
+	responded time.Time
+	closed    time.Time
+
+	request  []byte
+	response []byte
+}
+
+type tcpEndpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+func parseEndpoint(addr string) tcpEndpoint {
+	host, port, _ := net.SplitHostPort(addr)
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ep := tcpEndpoint{ip: net.ParseIP(host)}
+	if ep.ip == nil {
+		ep.ip = net.IPv4zero
+	}
+	n, _ := strconv.ParseUint(port, 10, 16)
+	ep.port = uint16(n)
+	return ep
+}
+
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// segment builds an IP packet (v4 if both ends are v4, otherwise v6)
+// carrying a single TCP segment.
+func (p *pcapFile) segment(src, dst tcpEndpoint, seq, ack uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	var pseudo bytes.Buffer
+	var ip []byte
+	if src4, dst4 := src.ip.To4(), dst.ip.To4(); src4 != nil && dst4 != nil {
+		pseudo.Write(src4)
+		pseudo.Write(dst4)
+		binary.Write(&pseudo, binary.BigEndian, uint16(6))
+		binary.Write(&pseudo, binary.BigEndian, uint16(len(tcp)))
+
+		p.ipid++
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[4:], p.ipid)
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	} else {
+		pseudo.Write(src.ip.To16())
+		pseudo.Write(dst.ip.To16())
+		binary.Write(&pseudo, binary.BigEndian, uint32(len(tcp)))
+		binary.Write(&pseudo, binary.BigEndian, uint32(6))
+
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.ip.To16())
+		copy(ip[24:], dst.ip.To16())
+	}
+
+	var sum uint32
+	pb := pseudo.Bytes()
+	for i := 0; i+1 < len(pb); i += 2 {
+		sum += uint32(pb[i])<<8 | uint32(pb[i+1])
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum))
+
+	return append(ip, tcp...)
+}
+
+// WriteStream writes out a whole TCP connection: the handshake, the
+// request, the response, and the teardown.  The packets for a stream
+// are written together, so that streams from concurrent exchanges
+// don't end up interleaved.
+func (p *pcapFile) WriteStream(s pcapStream) error {
+	if p == nil {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	client, server := parseEndpoint(s.client), parseEndpoint(s.server)
+	var cseq, sseq uint32
+
+	// timestamps that we don't know are taken to be the same as
+	// the one before, and none are allowed to go backwards.
+	last := s.opened
+	for _, t := range []time.Time{s.requested, s.responded, s.closed} {
+		if last.IsZero() {
+			last = t
+		}
+	}
+	when := func(t time.Time) time.Time {
+		if t.After(last) {
+			last = t
+		}
+		return last
+	}
+
+	var pkts []pcapPacket
+	send := func(at time.Time, fromClient bool, flags byte, payload []byte, comment string) {
+		if fromClient {
+			pkts = append(pkts, pcapPacket{at, p.segment(client, server, cseq, sseq, flags, payload), comment})
+			cseq += uint32(len(payload))
+		} else {
+			pkts = append(pkts, pcapPacket{at, p.segment(server, client, sseq, cseq, flags, payload), comment})
+			sseq += uint32(len(payload))
+		}
+		if flags&(tcpSYN|tcpFIN) != 0 {
+			if fromClient {
+				cseq++
+			} else {
+				sseq++
+			}
+		}
+	}
+	data := func(at time.Time, fromClient bool, b []byte) {
+		for len(b) > 0 {
+			n := len(b)
+			if n > pcapMSS {
+				n = pcapMSS
+			}
+			flags := byte(tcpACK)
+			if n == len(b) {
+				flags |= tcpPSH
+			}
+			send(at, fromClient, flags, b[:n], "")
+			b = b[n:]
+		}
+		send(at, !fromClient, tcpACK, nil, "")
+	}
+
+	at := when(s.opened)
+	send(at, true, tcpSYN, nil, s.comment)
+	send(at, false, tcpSYN|tcpACK, nil, "")
+	send(at, true, tcpACK, nil, "")
+
+	data(when(s.requested), true, s.request)
+	data(when(s.responded), false, s.response)
+
+	at = when(s.closed)
+	send(at, true, tcpFIN|tcpACK, nil, "")
+	send(at, false, tcpFIN|tcpACK, nil, "")
+	send(at, true, tcpACK, nil, "")
+
+	for _, pkt := range pkts {
+		if err := p.packet(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wireMessage puts an HTTP/1.x message back together, as it would
+// have been sent, from its start line, headers and (decoded) body.
+func wireMessage(start, host string, h http.Header, chunked bool, body []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(start + "\r\n")
+	if host != "" {
+		b.WriteString("Host: " + host + "\r\n")
+	}
+	h.WriteSubset(&b, map[string]bool{"Host": true, "Content-Length": true, "Transfer-Encoding": true})
+
+	if chunked {
+		b.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+		if len(body) > 0 {
+			fmt.Fprintf(&b, "%x\r\n", len(body))
+			b.Write(body)
+			b.WriteString("\r\n")
+		}
+		b.WriteString("0\r\n\r\n")
+		return b.Bytes()
+	}
+
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	} else if n := h.Get("Content-Length"); n != "" {
+		b.WriteString("Content-Length: " + n + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+func decrypted(tls bool) string {
+	if tls {
+		return " (decrypted)"
+	}
+	return ""
+}
+
+// Exchange writes both sides of a relayed exchange to the capture;
+// first the client's connection to us, then ours to the upstream.
+func (p *pcapFile) Exchange(id uint64, req *http.Request, received time.Time, reqBody []byte, res *http.Response, resBody []byte, sent http.Header, sentBody []byte, trace *exchangeTrace) error {
+	if p == nil {
+		return nil
+	}
+
+	if err := p.clientStream(id, req, received, reqBody, res.StatusCode, sent, sentBody); err != nil {
+		return err
+	}
+
+	up := res.Request
+	host := up.Host
+	if host == "" {
+		host = up.URL.Host
+	}
+	if up.ContentLength == 0 {
+		reqBody = nil
+	}
+
+	trace.lock.Lock()
+	s := pcapStream{
+		comment:   fmt.Sprintf("gotcha exchange #%d, upstream connection%s", id, decrypted(res.TLS != nil)),
+		client:    trace.local,
+		server:    trace.remote,
+		opened:    trace.connectDone,
+		requested: trace.wroteRequest,
+		responded: trace.firstByte,
+		closed:    trace.bodyDone,
+		request:   wireMessage(fmt.Sprintf("%s %s HTTP/1.1", up.Method, up.URL.RequestURI()), host, up.Header, isChunked(up.TransferEncoding), reqBody),
+		response:  wireMessage(fmt.Sprintf("%s %s", res.Proto, res.Status), "", res.Header, isChunked(res.TransferEncoding), resBody),
+	}
+	trace.lock.Unlock()
+	return p.WriteStream(s)
+}
+
+// Failed writes the client's side of an exchange that gotcha had to
+// answer itself (with a 599, say), since there is no upstream response
+// to show for it.
+func (p *pcapFile) Failed(id uint64, req *http.Request, received time.Time, reqBody []byte, status int, sent http.Header, sentBody []byte) error {
+	if p == nil {
+		return nil
+	}
+	return p.clientStream(id, req, received, reqBody, status, sent, sentBody)
+}
+
+// clientStream writes the request that the client sent to gotcha, and
+// the response gotcha sent back.
+func (p *pcapFile) clientStream(id uint64, req *http.Request, received time.Time, reqBody []byte, status int, sent http.Header, sentBody []byte) error {
+	local := ""
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr.String()
+	}
+	return p.WriteStream(pcapStream{
+		comment:   fmt.Sprintf("gotcha exchange #%d, client connection%s", id, decrypted(req.TLS != nil)),
+		client:    req.RemoteAddr,
+		server:    local,
+		opened:    received,
+		requested: received,
+		responded: time.Now(),
+		closed:    time.Now(),
+		request:   wireMessage(fmt.Sprintf("%s %s %s", req.Method, req.RequestURI, req.Proto), req.Host, req.Header, isChunked(req.TransferEncoding), reqBody),
+		response:  wireMessage(fmt.Sprintf("HTTP/1.1 %03d %s", status, http.StatusText(status)), "", sent, false, sentBody),
+	})
+}
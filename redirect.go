@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// redirectPolicy decides which redirects gotcha follows on the client's
+// behalf (when it isn't running with --redirect), what becomes of the
+// method and body of the request along the way, and which of the
+// client's headers go with it to another origin.
+type redirectPolicy struct {
+	maxHops    int
+	sameHost   bool
+	keepMethod bool
+
+	// headers dropped from requests that are redirected to an origin
+	// other than the one the client asked for.
+	strip map[string]bool
+}
+
+// redirectBodyLimit is as much of a request body as gotcha will keep,
+// just in case a redirect that keeps the body (like a 307) needs it sent
+// again.  Bigger bodies are streamed to the upstream, and any such
+// redirect goes back to the client.
+const redirectBodyLimit = 1 << 20
+
+// bufferSmallBody reads all of body, if there are no more than limit
+// bytes of it, so that it can be sent more than once.  Otherwise, it
+// returns nil, along with a reader that still gives the whole body.
+func bufferSmallBody(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, body, err
+	}
+	if int64(len(b)) <= limit {
+		return b, ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	return nil, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), body), body}, nil
+}
+
+// sensitiveHeaders are the ones that browsers (and Go) won't pass on
+// to another origin, since they identify the user to the original.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Cookie2",
+	"Www-Authenticate",
+}
+
+func newRedirectPolicy(opt *Opt) *redirectPolicy {
+	p := &redirectPolicy{
+		maxHops:    opt.MaxRedirects,
+		sameHost:   opt.SameHostRedirects,
+		keepMethod: opt.RedirectKeepMethod,
+		strip:      make(map[string]bool),
+	}
+	for _, header := range sensitiveHeaders {
+		p.strip[header] = true
+	}
+	for _, header := range splitList(opt.RedirectStrip) {
+		p.strip[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, header := range splitList(opt.RedirectForward) {
+		delete(p.strip, http.CanonicalHeaderKey(header))
+	}
+	return p
+}
+
+func origin(r *http.Request) string {
+	return r.URL.Scheme + "://" + r.URL.Host
+}
+
+// Follow is called (by http.Client's CheckRedirect) with the request
+// that the client is about to make for the redirect in req.Response,
+// which it is free to change.  It explains each decision as it makes
+// it, and returns http.ErrUseLastResponse to hand the redirect back to
+// the client.
+func (p *redirectPolicy) Follow(out io.Writer, req *http.Request, via []*http.Request) error {
+	first, prev := via[0], via[len(via)-1]
+	status := 0
+	if req.Response != nil {
+		status = req.Response.StatusCode
+		fmt.Fprintf(out, "@C{redirect:}        %s from @Y{%s}\n", req.Response.Status, prev.URL)
+	}
+	fmt.Fprintf(out, "                 to @Y{%s}\n", req.URL)
+	fmt.Fprintf(out, "@C{hop:}             %d of at most %d (--max-redirects)\n", len(via), p.maxHops)
+
+	if len(via) > p.maxHops {
+		fmt.Fprintf(out, "@C{decision:}        @Y{not following}; that's as many as --max-redirects allows,\n")
+		fmt.Fprintf(out, "                 so the redirect goes back to the client\n\n")
+		return http.ErrUseLastResponse
+	}
+	if p.sameHost && req.URL.Host != first.URL.Host {
+		fmt.Fprintf(out, "@C{decision:}        @Y{not following}; %s is not %s (--same-host-redirects),\n", req.URL.Host, first.URL.Host)
+		fmt.Fprintf(out, "                 so the redirect goes back to the client\n\n")
+		return http.ErrUseLastResponse
+	}
+
+	dropped := p.method(out, req, prev, first, status)
+	p.headers(out, req, first, dropped)
+
+	fmt.Fprintf(out, "@C{decision:}        @G{following}\n\n")
+	return nil
+}
+
+// method works out what to send for a redirect.  303 See Other always
+// means a GET (unless it was a HEAD), and 307 and 308 always keep the
+// method and body.  For 301 and 302, http.Client does what browsers do
+// for POST with every method but GET and HEAD, turning it into a GET;
+// --redirect-keep-method has them keep it instead, as RFC 7231 meant.
+// It returns whether the body was dropped.
+func (p *redirectPolicy) method(out io.Writer, req, prev, first *http.Request, status int) bool {
+	switch {
+	case (status == 301 || status == 302) && p.keepMethod && req.Method != prev.Method:
+		req.Method = prev.Method
+		req.ContentLength = first.ContentLength
+		req.GetBody = first.GetBody
+		if first.GetBody != nil {
+			req.Body, _ = first.GetBody()
+		}
+		fmt.Fprintf(out, "@C{method:}          %s kept (--redirect-keep-method), body replayed\n", req.Method)
+
+	case req.Method != prev.Method:
+		fmt.Fprintf(out, "@C{method:}          @Y{%s became %s} (%d), body dropped\n", prev.Method, req.Method, status)
+		return true
+
+	case req.Body != nil && req.Body != http.NoBody:
+		fmt.Fprintf(out, "@C{method:}          %s kept (%d), body replayed\n", req.Method, status)
+
+	default:
+		fmt.Fprintf(out, "@C{method:}          %s kept (%d)\n", req.Method, status)
+	}
+	return false
+}
+
+// headers replaces the client's headers that http.Client copied onto
+// the redirect (by its own rules) with ones chosen by ours, keeping
+// the Referer it worked out.  Headers describing the body go if the
+// body does.
+func (p *redirectPolicy) headers(out io.Writer, req, first *http.Request, bodyDropped bool) {
+	referer := req.Header.Get("Referer")
+
+	if origin(req) == origin(first) {
+		fmt.Fprintf(out, "@C{origin:}          unchanged; all headers forwarded\n")
+	} else {
+		fmt.Fprintf(out, "@C{origin:}          @Y{changed} from %s to %s\n", origin(first), origin(req))
+	}
+
+	var dropped []string
+	header := make(http.Header)
+	for name, values := range first.Header {
+		if name == "Referer" || (bodyDropped && strings.HasPrefix(name, "Content-")) {
+			continue
+		}
+		if origin(req) != origin(first) && p.strip[name] {
+			dropped = append(dropped, name)
+			continue
+		}
+		header[name] = append([]string(nil), values...)
+	}
+	if referer != "" {
+		header.Set("Referer", referer)
+	}
+	req.Header = header
+
+	if len(dropped) > 0 {
+		sort.Strings(dropped)
+		fmt.Fprintf(out, "@C{headers:}         @Y{dropped %s}\n", strings.Join(dropped, ", "))
+		fmt.Fprintf(out, "                 (not sent to other origins; see --redirect-forward)\n")
+	}
+}
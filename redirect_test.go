@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestRequest(t *testing.T, method, url string, body []byte) *http.Request {
+	var r *http.Request
+	var err error
+	if body != nil {
+		r, err = http.NewRequest(method, url, bytes.NewReader(body))
+	} else {
+		r, err = http.NewRequest(method, url, nil)
+	}
+	if err != nil {
+		t.Fatalf("failed to build %s %s request: %s", method, url, err)
+	}
+	return r
+}
+
+func TestRedirectMethod(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		keepMethod bool
+		sent       string // the method of the original request
+		following  string // the method http.Client picked for the redirect
+		want       string
+		dropped    bool
+		replayed   bool
+	}{
+		{"303 turns POST into GET", 303, false, "POST", "GET", "GET", true, false},
+		{"303 ignores --redirect-keep-method", 303, true, "POST", "GET", "GET", true, false},
+		{"301 turns POST into GET", 301, false, "POST", "GET", "GET", true, false},
+		{"302 turns PUT into GET", 302, false, "PUT", "GET", "GET", true, false},
+		{"301 keeps POST with --redirect-keep-method", 301, true, "POST", "GET", "POST", false, true},
+		{"302 keeps PUT with --redirect-keep-method", 302, true, "PUT", "GET", "PUT", false, true},
+		{"302 keeps GET", 302, false, "GET", "GET", "GET", false, false},
+		{"307 keeps POST", 307, false, "POST", "POST", "POST", false, false},
+		{"308 keeps DELETE", 308, false, "DELETE", "DELETE", "DELETE", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &redirectPolicy{keepMethod: test.keepMethod}
+			first := newTestRequest(t, test.sent, "http://a.test/start", []byte("hello"))
+			req := newTestRequest(t, test.following, "http://a.test/next", nil)
+
+			dropped := p.method(ioutil.Discard, req, first, first, test.status)
+			if req.Method != test.want {
+				t.Errorf("redirect was sent as %s, not %s", req.Method, test.want)
+			}
+			if dropped != test.dropped {
+				t.Errorf("body dropped is %v, not %v", dropped, test.dropped)
+			}
+			if test.replayed {
+				if req.Body == nil {
+					t.Fatalf("body was not replayed")
+				}
+				b, _ := ioutil.ReadAll(req.Body)
+				if string(b) != "hello" {
+					t.Errorf("body replayed as '%s', not 'hello'", b)
+				}
+				if req.ContentLength != 5 {
+					t.Errorf("Content-Length of the redirect is %d, not 5", req.ContentLength)
+				}
+			}
+		})
+	}
+}
+
+func TestRedirectHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		to       string
+		forward  []string
+		strip    []string
+		dropBody bool
+		want     []string
+	}{
+		{
+			name: "same origin keeps everything",
+			to:   "http://a.test/next",
+			want: []string{"Accept", "Authorization", "Content-Type", "Cookie", "Referer", "X-Api-Key"},
+		},
+		{
+			name: "another host drops credentials",
+			to:   "http://b.test/next",
+			want: []string{"Accept", "Content-Type", "Referer", "X-Api-Key"},
+		},
+		{
+			name: "another port is another origin",
+			to:   "http://a.test:8080/next",
+			want: []string{"Accept", "Content-Type", "Referer", "X-Api-Key"},
+		},
+		{
+			name: "another scheme is another origin",
+			to:   "https://a.test/next",
+			want: []string{"Accept", "Content-Type", "Referer", "X-Api-Key"},
+		},
+		{
+			name:    "--redirect-forward keeps a credential",
+			to:      "http://b.test/next",
+			forward: []string{"authorization"},
+			want:    []string{"Accept", "Authorization", "Content-Type", "Referer", "X-Api-Key"},
+		},
+		{
+			name:  "--redirect-strip drops another header",
+			to:    "http://b.test/next",
+			strip: []string{"x-api-key"},
+			want:  []string{"Accept", "Content-Type", "Referer"},
+		},
+		{
+			name:  "--redirect-strip only applies to other origins",
+			to:    "http://a.test/next",
+			strip: []string{"x-api-key"},
+			want:  []string{"Accept", "Authorization", "Content-Type", "Cookie", "Referer", "X-Api-Key"},
+		},
+		{
+			name:     "a dropped body takes its headers with it",
+			to:       "http://a.test/next",
+			dropBody: true,
+			want:     []string{"Accept", "Authorization", "Cookie", "Referer", "X-Api-Key"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newRedirectPolicy(&Opt{RedirectForward: test.forward, RedirectStrip: test.strip})
+			first := newTestRequest(t, "POST", "http://a.test/start", []byte("hello"))
+			first.Header.Set("Accept", "*/*")
+			first.Header.Set("Authorization", "Bearer sekrit")
+			first.Header.Set("Content-Type", "text/plain")
+			first.Header.Set("Cookie", "session=sekrit")
+			first.Header.Set("Referer", "http://elsewhere.test/")
+			first.Header.Set("X-Api-Key", "sekrit")
+
+			req := newTestRequest(t, "POST", test.to, nil)
+			req.Header.Set("Referer", "http://a.test/start")
+			p.headers(ioutil.Discard, req, first, test.dropBody)
+
+			var got []string
+			for name := range req.Header {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("redirect has headers %v, not %v", got, test.want)
+			}
+			if referer := req.Header.Get("Referer"); referer != "http://a.test/start" {
+				t.Errorf("redirect has Referer '%s', not the one http.Client worked out", referer)
+			}
+		})
+	}
+}
+
+func TestRedirectMaxHops(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxHops int
+		hops    int
+		follow  bool
+	}{
+		{"--max-redirects 0 follows nothing", 0, 1, false},
+		{"the first of one", 1, 1, true},
+		{"one too many", 1, 2, false},
+		{"the last of ten", 10, 10, true},
+		{"the eleventh of ten", 10, 11, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &redirectPolicy{maxHops: test.maxHops}
+			var via []*http.Request
+			for i := 0; i < test.hops; i++ {
+				via = append(via, newTestRequest(t, "GET", "http://a.test/", nil))
+			}
+			req := newTestRequest(t, "GET", "http://a.test/next", nil)
+
+			err := p.Follow(ioutil.Discard, req, via)
+			if test.follow && err != nil {
+				t.Errorf("redirect was not followed: %s", err)
+			}
+			if !test.follow && err != http.ErrUseLastResponse {
+				t.Errorf("redirect was not handed back to the client (got %v)", err)
+			}
+		})
+	}
+}
+
+func TestBufferSmallBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		limit    int64
+		buffered bool
+	}{
+		{"empty", "", 4, true},
+		{"under the limit", "abc", 4, true},
+		{"at the limit", "abcd", 4, true},
+		{"over the limit", "abcde", 4, false},
+		{"well over the limit", strings.Repeat("x", 100), 4, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, r, err := bufferSmallBody(ioutil.NopCloser(strings.NewReader(test.body)), test.limit)
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if test.buffered && string(b) != test.body {
+				t.Errorf("buffered '%s', not '%s'", b, test.body)
+			}
+			if !test.buffered && b != nil {
+				t.Errorf("buffered %d bytes, over the limit of %d", len(b), test.limit)
+			}
+			all, _ := ioutil.ReadAll(r)
+			if string(all) != test.body {
+				t.Errorf("body reads as '%s', not '%s'", all, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	fmt "github.com/jhunt/go-ansi"
+	"net"
+	"strings"
+	"time"
+)
+
+// upstreamDialer connects to the upstream (or proxy), looking names up
+// the way it has been told to: by --resolve overrides, which pin a
+// host and port to an address (as curl's --resolve does), or through
+// a particular DNS server, or failing those, the system resolver.
+type upstreamDialer struct {
+	net.Dialer
+
+	resolve   map[string]string
+	dnsServer string
+}
+
+// parseResolve parses --resolve overrides, which look like
+// HOST:PORT:ADDRESS, where an IPv6 ADDRESS may be in brackets.
+func parseResolve(l []string) (map[string]string, error) {
+	resolve := make(map[string]string)
+	for _, s := range splitList(l) {
+		parts := strings.SplitN(s, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --resolve '%s' (should be HOST:PORT:ADDRESS)", s)
+		}
+		addr := strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid --resolve '%s' ('%s' is not an IP address)", s, addr)
+		}
+		resolve[strings.ToLower(net.JoinHostPort(parts[0], parts[1]))] = net.JoinHostPort(addr, parts[1])
+	}
+	return resolve, nil
+}
+
+// parseDNSServer fills in the port (53) of a --dns-server, if missing.
+func parseDNSServer(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s, nil
+	}
+	addr := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if net.ParseIP(addr) == nil {
+		return "", fmt.Errorf("invalid --dns-server '%s' (should be an IP address, with an optional port)", s)
+	}
+	return net.JoinHostPort(addr, "53"), nil
+}
+
+func newUpstreamDialer(o transportOptions) *upstreamDialer {
+	d := &upstreamDialer{
+		Dialer:    net.Dialer{Timeout: o.dialTimeout, KeepAlive: o.keepAlive},
+		resolve:   o.resolve,
+		dnsServer: o.dnsServer,
+	}
+	if o.keepAlive == 0 {
+		d.KeepAlive = -1
+	}
+	if d.dnsServer != "" {
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dns net.Dialer
+				dns.Timeout = 5 * time.Second
+				return dns.DialContext(ctx, network, d.dnsServer)
+			},
+		}
+	}
+	return d
+}
+
+// lookup works out where to connect to for addr, and how we got there,
+// for the dump.
+func (d *upstreamDialer) lookup(addr string) (string, string) {
+	if to, ok := d.resolve[strings.ToLower(addr)]; ok {
+		return to, "--resolve"
+	}
+	if net.ParseIP(hostOnly(addr)) != nil {
+		return addr, ""
+	}
+	if d.dnsServer != "" {
+		return addr, "dns server " + d.dnsServer
+	}
+	return addr, "system resolver"
+}
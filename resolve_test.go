@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want map[string]string
+		ok   bool
+	}{
+		{"none", nil, map[string]string{}, true},
+		{"IPv4", []string{"api.example.com:443:192.0.2.1"}, map[string]string{"api.example.com:443": "192.0.2.1:443"}, true},
+		{"IPv6", []string{"api.example.com:443:2001:db8::1"}, map[string]string{"api.example.com:443": "[2001:db8::1]:443"}, true},
+		{"bracketed IPv6", []string{"api.example.com:443:[2001:db8::1]"}, map[string]string{"api.example.com:443": "[2001:db8::1]:443"}, true},
+		{"host names are not case-sensitive", []string{"API.Example.com:443:192.0.2.1"}, map[string]string{"api.example.com:443": "192.0.2.1:443"}, true},
+		{
+			name: "several, separated by commas",
+			in:   []string{"a.test:80:192.0.2.1,b.test:443:192.0.2.2"},
+			want: map[string]string{"a.test:80": "192.0.2.1:80", "b.test:443": "192.0.2.2:443"},
+			ok:   true,
+		},
+		{
+			name: "several, given more than once",
+			in:   []string{"a.test:80:192.0.2.1", "b.test:443:192.0.2.2"},
+			want: map[string]string{"a.test:80": "192.0.2.1:80", "b.test:443": "192.0.2.2:443"},
+			ok:   true,
+		},
+		{"no address", []string{"api.example.com:443"}, nil, false},
+		{"no port", []string{"api.example.com::192.0.2.1"}, nil, false},
+		{"no host", []string{":443:192.0.2.1"}, nil, false},
+		{"a host name for an address", []string{"api.example.com:443:other.example.com"}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseResolve(test.in)
+			if !test.ok {
+				if err == nil {
+					t.Errorf("parsed %v, which should have failed", test.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse %v: %s", test.in, err)
+			}
+			if len(got) != len(test.want) {
+				t.Errorf("got %v, not %v", got, test.want)
+			}
+			for k, v := range test.want {
+				if got[k] != v {
+					t.Errorf("%s resolves to '%s', not '%s'", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"192.0.2.53", "192.0.2.53:53", true},
+		{"192.0.2.53:5353", "192.0.2.53:5353", true},
+		{"2001:db8::53", "[2001:db8::53]:53", true},
+		{"[2001:db8::53]", "[2001:db8::53]:53", true},
+		{"[2001:db8::53]:5353", "[2001:db8::53]:5353", true},
+		{"dns.example.com", "", false},
+		{"not an address", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := parseDNSServer(test.in)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("parsed '%s' as '%s', which should have failed", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse '%s': %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("parsed '%s' as '%s', not '%s'", test.in, got, test.want)
+		}
+	}
+}
+
+func TestDialerLookup(t *testing.T) {
+	resolve, err := parseResolve([]string{"api.example.com:443:192.0.2.1"})
+	if err != nil {
+		t.Fatalf("failed to parse --resolve: %s", err)
+	}
+	d := newUpstreamDialer(transportOptions{resolve: resolve})
+
+	tests := []struct {
+		addr string
+		to   string
+	}{
+		{"api.example.com:443", "192.0.2.1:443"},
+		{"API.EXAMPLE.COM:443", "192.0.2.1:443"},
+		{"api.example.com:80", "api.example.com:80"},
+		{"other.example.com:443", "other.example.com:443"},
+	}
+
+	for _, test := range tests {
+		if to, _ := d.lookup(test.addr); to != test.to {
+			t.Errorf("%s is dialed at %s, not %s", test.addr, to, test.to)
+		}
+	}
+}
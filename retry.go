@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy has gotcha try a request again when the upstream can't
+// be reached, drops the connection, or answers with one of a given set
+// of statuses, waiting a little longer each time (exponential backoff,
+// with jitter, so that retries from many clients don't line up).
+//
+// Only idempotent methods are retried, unless told otherwise, since
+// for anything else the upstream may have done the work before it
+// failed.  Request bodies are buffered, so that they can be replayed.
+type retryPolicy struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	statuses   map[int]bool
+	anyMethod  bool
+
+	onlyHeaders bool
+}
+
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+func parseRetryPolicy(opt *Opt) (*retryPolicy, error) {
+	p := &retryPolicy{
+		retries:   opt.Retries,
+		statuses:  make(map[int]bool),
+		anyMethod: opt.RetryAnyMethod,
+
+		onlyHeaders: opt.OnlyHeaders,
+	}
+	for _, s := range splitList(opt.RetryOn) {
+		status, err := strconv.Atoi(s)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid --retry-on '%s' (should be an HTTP status code, like 503)", s)
+		}
+		p.statuses[status] = true
+	}
+	err := parseDurations([]durationOption{
+		{"--retry-backoff", opt.RetryBackoff, &p.backoff},
+		{"--retry-max-backoff", opt.RetryMaxBackoff, &p.maxBackoff},
+	})
+	return p, err
+}
+
+// Enabled tells whether requests will ever be retried, and so whether
+// their bodies need to be kept around.
+func (p *retryPolicy) Enabled() bool {
+	return p.retries > 0
+}
+
+// failed says what went wrong with an attempt, if it is something that
+// trying again might fix: a connection that couldn't be made, or was
+// lost, or timed out, or a response with one of the --retry-on
+// statuses.  Certificate problems and the like aren't worth retrying.
+func (p *retryPolicy) failed(res *http.Response, err error) string {
+	if err != nil {
+		var op *net.OpError
+		var nerr net.Error
+		if errors.As(err, &op) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+			(errors.As(err, &nerr) && nerr.Timeout()) {
+			return err.Error()
+		}
+		return ""
+	}
+	if p.statuses[res.StatusCode] {
+		return res.Status
+	}
+	return ""
+}
+
+// delay is how long to wait before the given retry (the first is 1):
+// the backoff, doubled for each retry before it, up to the maximum,
+// of which a random half is taken off.
+func (p *retryPolicy) delay(retry int) time.Duration {
+	d := p.backoff
+	for n := 1; n < retry && (p.maxBackoff <= 0 || d < p.maxBackoff) && d < math.MaxInt64/2; n++ {
+		d *= 2
+	}
+	if p.maxBackoff > 0 && d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Do sends req, and tries it again as the policy allows, dumping a
+// RETRY block for each attempt that failed: why, how long it took, the
+// response it got (if any), what happens next, and the request sent to
+// try again.  Each attempt is reported, and retarget gets to point each
+// retry at some other upstream instance, saying which (or "" if it
+// doesn't).  Along with the last response, Do returns how long the
+// last attempt took; the time spent backing off isn't counted.
+func (p *retryPolicy) Do(out io.Writer, id uint64, client *http.Client, req *http.Request,
+	report func(*http.Response, error), retarget func(*http.Request) string) (*http.Response, time.Duration, error) {
+
+	attempts := p.retries + 1
+	r := req
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		res, err := client.Do(r)
+		took := time.Since(start)
+		report(res, err)
+
+		problem := p.failed(res, err)
+		if problem == "" || !p.Enabled() {
+			return res, took, err
+		}
+
+		banner(out, "---", "RETRY", id)
+		fmt.Fprintf(out, "@C{attempt:}         %d of %d @R{failed}\n", attempt, attempts)
+		fmt.Fprintf(out, "@C{because:}         %s\n", problem)
+		fmt.Fprintf(out, "@C{took:}            @G{%5.3f ms}\n", float64(took.Nanoseconds())/1000000)
+		if attempt >= attempts {
+			fmt.Fprintf(out, "@C{decision:}        @R{giving up}; out of attempts (--retries)\n\n")
+			return res, took, err
+		}
+		if !idempotentMethods[req.Method] && !p.anyMethod {
+			fmt.Fprintf(out, "@C{decision:}        @Y{not retrying}; %s isn't idempotent (see --retry-any-method)\n\n", req.Method)
+			return res, took, err
+		}
+
+		if res != nil {
+			fmt.Fprintf(out, "\n")
+			dumpResponse(out, res, p.onlyHeaders)
+			fmt.Fprintf(out, "\n")
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		r = req.Clone(req.Context())
+		if req.GetBody != nil {
+			r.Body, _ = req.GetBody()
+		}
+		delay := p.delay(attempt)
+		fmt.Fprintf(out, "@C{backoff:}         @G{%5.3f ms}\n", float64(delay.Nanoseconds())/1000000)
+		if to := retarget(r); to != "" {
+			fmt.Fprintf(out, "@C{retrying:}        @Y{%s}\n", to)
+		}
+		if req.GetBody != nil && req.ContentLength != 0 {
+			fmt.Fprintf(out, "@C{decision:}        retrying, with the request body replayed\n\n")
+		} else {
+			fmt.Fprintf(out, "@C{decision:}        retrying\n\n")
+		}
+		dumpRequest(out, r, p.onlyHeaders)
+
+		time.Sleep(delay)
+	}
+}
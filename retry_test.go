@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryPolicyFailed(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		retry  bool
+	}{
+		{name: "connection refused", err: refused, retry: true},
+		{name: "connection refused, as http.Client says it", err: &url.Error{Op: "Get", URL: "http://a.test/", Err: refused}, retry: true},
+		{name: "connection dropped", err: &url.Error{Op: "Get", URL: "http://a.test/", Err: io.EOF}, retry: true},
+		{name: "response cut short", err: io.ErrUnexpectedEOF, retry: true},
+		{name: "timed out", err: &url.Error{Op: "Get", URL: "http://a.test/", Err: timeoutError{}}, retry: true},
+		{name: "bad certificate", err: &url.Error{Op: "Get", URL: "https://a.test/", Err: x509.UnknownAuthorityError{}}, retry: false},
+		{name: "some other error", err: errors.New("stopped after 10 redirects"), retry: false},
+		{name: "a --retry-on status", status: 503, retry: true},
+		{name: "another --retry-on status", status: 429, retry: true},
+		{name: "a status not in --retry-on", status: 500, retry: false},
+		{name: "success", status: 200, retry: false},
+	}
+
+	p := &retryPolicy{retries: 2, statuses: map[int]bool{429: true, 503: true}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var res *http.Response
+			if test.err == nil {
+				res = &http.Response{StatusCode: test.status, Status: http.StatusText(test.status)}
+			}
+			problem := p.failed(res, test.err)
+			if retry := problem != ""; retry != test.retry {
+				t.Errorf("retrying is %v (problem '%s'), not %v", retry, problem, test.retry)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name       string
+		backoff    time.Duration
+		maxBackoff time.Duration
+		retry      int
+		min, max   time.Duration
+	}{
+		{"first retry", 100 * ms, 5000 * ms, 1, 50 * ms, 100 * ms},
+		{"second retry", 100 * ms, 5000 * ms, 2, 100 * ms, 200 * ms},
+		{"fourth retry", 100 * ms, 5000 * ms, 4, 400 * ms, 800 * ms},
+		{"up to the maximum", 100 * ms, 5000 * ms, 7, 2500 * ms, 5000 * ms},
+		{"well past the maximum", 100 * ms, 5000 * ms, 1000, 2500 * ms, 5000 * ms},
+		{"backoff over the maximum", 10000 * ms, 5000 * ms, 1, 2500 * ms, 5000 * ms},
+		{"no maximum", 100 * ms, 0, 6, 1600 * ms, 3200 * ms},
+		{"no maximum, and many retries", 100 * ms, 0, 1000, 1 << 61, math.MaxInt64},
+		{"no backoff", 0, 5000 * ms, 3, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &retryPolicy{backoff: test.backoff, maxBackoff: test.maxBackoff}
+			for n := 0; n < 100; n++ {
+				if d := p.delay(test.retry); d < test.min || d > test.max {
+					t.Fatalf("waited %s before retry %d, outside of %s-%s", d, test.retry, test.min, test.max)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// revocationChecker finds out whether the certificates an upstream
+// presents have been revoked by their issuers; Go's own verification
+// doesn't check.  For each certificate, it tries a stapled OCSP
+// response (for the leaf), then the OCSP responders listed in the
+// certificate (AIA), then its CRL distribution points, stopping at
+// the first definitive answer.
+//
+// Responses and CRLs are cached until their next update (or for an
+// hour, if they don't say), and failures for a minute, so that every
+// exchange doesn't have to go asking again.
+type revocationChecker struct {
+	lock  sync.Mutex
+	cache map[string]*revocationFetch
+
+	client *http.Client
+}
+
+type revocationFetch struct {
+	body    []byte
+	err     error
+	expires time.Time
+}
+
+// revocationStatus is what we found out about one certificate.
+type revocationStatus struct {
+	status    int // ocsp.Good, ocsp.Revoked, or ocsp.Unknown
+	source    string
+	revokedAt time.Time
+	reason    int
+	updated   time.Time
+	next      time.Time
+	problems  []string
+}
+
+// newRevocationChecker fetches OCSP responses and CRLs the way gotcha
+// connects to the upstream (with the same --resolve overrides, DNS
+// server and proxy), trusting the same roots, but over connections of
+// its own, and without any of the upstream's TLS settings, which are
+// for talking to the upstream, not its CA.
+func newRevocationChecker(upstream *http.Transport, roots *x509.CertPool) *revocationChecker {
+	t := upstream.Clone()
+	t.DialTLSContext = nil
+	t.TLSClientConfig = &tls.Config{RootCAs: roots}
+	return &revocationChecker{
+		cache:  make(map[string]*revocationFetch),
+		client: &http.Client{Transport: t, Timeout: 10 * time.Second},
+	}
+}
+
+// fetch retrieves (and caches) an OCSP response or a CRL.  OCSP
+// requests are POSTed; CRLs are fetched with a GET.  The expiry of
+// the cached copy is left to the caller, who is in a position to
+// parse the thing and find out when it expires.
+func (c *revocationChecker) fetch(url string, request []byte) *revocationFetch {
+	key := url + "\x00" + string(request)
+
+	c.lock.Lock()
+	if f, ok := c.cache[key]; ok && time.Now().Before(f.expires) {
+		c.lock.Unlock()
+		return f
+	}
+	c.lock.Unlock()
+
+	f := &revocationFetch{expires: time.Now().Add(time.Minute)}
+	var res *http.Response
+	if request != nil {
+		res, f.err = c.client.Post(url, "application/ocsp-request", bytes.NewReader(request))
+	} else {
+		res, f.err = c.client.Get(url)
+	}
+	if f.err == nil {
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			f.err = fmt.Errorf("%s returned %s", url, res.Status)
+		} else {
+			f.body, f.err = ioutil.ReadAll(io.LimitReader(res.Body, 32<<20))
+		}
+	}
+
+	c.lock.Lock()
+	c.cache[key] = f
+	c.lock.Unlock()
+	return f
+}
+
+func (c *revocationChecker) expire(f *revocationFetch, next time.Time) {
+	if next.IsZero() {
+		next = time.Now().Add(time.Hour)
+	}
+	c.lock.Lock()
+	f.expires = next
+	c.lock.Unlock()
+}
+
+// stale notes when the information we have is past its next update,
+// in which case it may not be telling the whole story.
+func (st *revocationStatus) stale() {
+	if !st.next.IsZero() && time.Now().After(st.next) {
+		st.problems = append(st.problems, fmt.Sprintf("%s: out of date (next update was %s)", st.source, st.next.UTC().Format(time.RFC3339)))
+	}
+}
+
+func (c *revocationChecker) fromOCSP(st *revocationStatus, der []byte, cert, issuer *x509.Certificate) bool {
+	res, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		st.problems = append(st.problems, fmt.Sprintf("%s: %s", st.source, err))
+		return false
+	}
+	if res.Status == ocsp.Unknown {
+		st.problems = append(st.problems, fmt.Sprintf("%s: responder doesn't know about this certificate", st.source))
+		return false
+	}
+	st.status, st.revokedAt, st.reason = res.Status, res.RevokedAt, res.RevocationReason
+	st.updated, st.next = res.ThisUpdate, res.NextUpdate
+	st.stale()
+	return true
+}
+
+func (c *revocationChecker) fromCRL(st *revocationStatus, der []byte, cert, issuer *x509.Certificate) bool {
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		st.problems = append(st.problems, fmt.Sprintf("%s: %s", st.source, err))
+		return false
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		st.problems = append(st.problems, fmt.Sprintf("%s: not signed by the issuer (%s)", st.source, err))
+		return false
+	}
+
+	st.status, st.updated, st.next = ocsp.Good, crl.ThisUpdate, crl.NextUpdate
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			st.status, st.revokedAt, st.reason = ocsp.Revoked, entry.RevocationTime, entry.ReasonCode
+			break
+		}
+	}
+	st.stale()
+	return true
+}
+
+// Check works out the revocation status of cert, as issued by issuer.
+// The staple is the OCSP response the upstream sent along with the
+// handshake, if any, and only applies to the leaf.
+func (c *revocationChecker) Check(cert, issuer *x509.Certificate, staple []byte) revocationStatus {
+	st := revocationStatus{status: ocsp.Unknown}
+	if issuer == nil {
+		st.problems = append(st.problems, "issuer certificate not available")
+		return st
+	}
+
+	if len(staple) > 0 {
+		st.source = "stapled ocsp"
+		if c.fromOCSP(&st, staple, cert, issuer) {
+			return st
+		}
+	}
+
+	for _, url := range cert.OCSPServer {
+		st.source = "ocsp " + url
+		req, err := ocsp.CreateRequest(cert, issuer, nil)
+		if err != nil {
+			st.problems = append(st.problems, fmt.Sprintf("%s: %s", st.source, err))
+			continue
+		}
+		f := c.fetch(url, req)
+		if f.err != nil {
+			st.problems = append(st.problems, fmt.Sprintf("%s: %s", st.source, f.err))
+			continue
+		}
+		if c.fromOCSP(&st, f.body, cert, issuer) {
+			c.expire(f, st.next)
+			return st
+		}
+	}
+
+	for _, url := range cert.CRLDistributionPoints {
+		st.source = "crl " + url
+		f := c.fetch(url, nil)
+		if f.err != nil {
+			st.problems = append(st.problems, fmt.Sprintf("%s: %s", st.source, f.err))
+			continue
+		}
+		if c.fromCRL(&st, f.body, cert, issuer) {
+			c.expire(f, st.next)
+			return st
+		}
+	}
+
+	st.source = ""
+	if len(st.problems) == 0 {
+		st.problems = append(st.problems, "no stapled ocsp response, ocsp responders or crl distribution points")
+	}
+	return st
+}
+
+var revocationReasons = map[int]string{
+	ocsp.Unspecified:          "unspecified",
+	ocsp.KeyCompromise:        "key compromise",
+	ocsp.CACompromise:         "ca compromise",
+	ocsp.AffiliationChanged:   "affiliation changed",
+	ocsp.Superseded:           "superseded",
+	ocsp.CessationOfOperation: "cessation of operation",
+	ocsp.CertificateHold:      "certificate hold",
+	ocsp.RemoveFromCRL:        "remove from crl",
+	ocsp.PrivilegeWithdrawn:   "privilege withdrawn",
+	ocsp.AACompromise:         "aa compromise",
+}
+
+// Dump checks every certificate in the chain the upstream presented
+// (save the root, which nobody can revoke) and prints what it found.
+// If the chain was verified, the verified chain is used, since that
+// is where the issuer of each certificate can be found for sure.
+func (c *revocationChecker) Dump(out io.Writer, state *tls.ConnectionState) {
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+
+	fmt.Fprintf(out, "@C{revocation:}\n")
+	for i, cert := range chain {
+		var issuer *x509.Certificate
+		if i+1 < len(chain) {
+			issuer = chain[i+1]
+		} else if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			break
+		}
+
+		st := c.Check(cert, issuer, staple(state, i))
+		switch st.status {
+		case ocsp.Good:
+			fmt.Fprintf(out, "  [%d] @G{good} via %s\n", i, st.source)
+		case ocsp.Revoked:
+			reason, ok := revocationReasons[st.reason]
+			if !ok {
+				reason = fmt.Sprintf("reason %d", st.reason)
+			}
+			fmt.Fprintf(out, "  [%d] @R{revoked} at %s (%s) via %s\n", i, st.revokedAt.UTC().Format(time.RFC3339), reason, st.source)
+		default:
+			fmt.Fprintf(out, "  [%d] @Y{unknown}\n", i)
+		}
+		if st.source != "" {
+			if st.next.IsZero() {
+				fmt.Fprintf(out, "      updated %s\n", st.updated.UTC().Format(time.RFC3339))
+			} else {
+				fmt.Fprintf(out, "      updated %s, next update %s\n", st.updated.UTC().Format(time.RFC3339), st.next.UTC().Format(time.RFC3339))
+			}
+		}
+		for _, problem := range st.problems {
+			fmt.Fprintf(out, "      @Y{%s}\n", problem)
+		}
+	}
+}
+
+func staple(state *tls.ConnectionState, i int) []byte {
+	if i != 0 {
+		return nil
+	}
+	return state.OCSPResponse
+}
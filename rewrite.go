@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// originRewriter points the links in a response at gotcha, rather than
+// the upstream, so that a browser looking at the upstream through
+// gotcha doesn't wander off to the real thing the first time it
+// follows one.  The upstream origin (scheme://host[:port]) is replaced
+// with gotcha's wherever it turns up in text bodies (JSON-escaped or
+// not) and the headers that carry URLs, and cookies scoped to the
+// upstream's domain are scoped to gotcha's host instead.
+type originRewriter struct {
+	from, to string
+	fromHost string
+}
+
+// rewrittenHeaders carry URLs (or origins) that a client will use.
+var rewrittenHeaders = []string{
+	"Location",
+	"Content-Location",
+	"Link",
+	"Access-Control-Allow-Origin",
+}
+
+func newOriginRewriter(upstream *url.URL, tls bool, host string) *originRewriter {
+	if host == "" {
+		return nil
+	}
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	return &originRewriter{
+		from:     upstream.Scheme + "://" + upstream.Host,
+		to:       scheme + "://" + host,
+		fromHost: upstream.Hostname(),
+	}
+}
+
+// Rewrite rewrites the response headers in h (which are the ones about
+// to go to the client), and returns the body to send, saying what it
+// changed.  Content-Length is fixed up if the body changes size.
+func (r *originRewriter) Rewrite(out io.Writer, h http.Header, body []byte) []byte {
+	if r == nil {
+		return body
+	}
+
+	var changed []string
+	for _, header := range rewrittenHeaders {
+		n := 0
+		for i, value := range h[header] {
+			v, c := replaceOrigin([]byte(value), r.from, r.to)
+			h[header][i] = string(v)
+			n += c
+		}
+		if n > 0 {
+			changed = append(changed, header)
+		}
+	}
+	for i, cookie := range h["Set-Cookie"] {
+		if v, domain := r.cookie(cookie); domain != "" {
+			h["Set-Cookie"][i] = v
+			changed = append(changed, fmt.Sprintf("Set-Cookie (dropped Domain=%s)", domain))
+		}
+	}
+
+	b, n, err := r.body(h, body)
+	if err != nil {
+		fmt.Fprintf(out, "@Y{not rewriting body:} %s\n", err)
+	}
+	if n > 0 {
+		changed = append(changed, fmt.Sprintf("body (%d found)", n))
+		if h.Get("Content-Length") != "" {
+			h.Set("Content-Length", strconv.Itoa(len(b)))
+		}
+	}
+
+	if len(changed) > 0 {
+		fmt.Fprintf(out, "@C{rewrote:}         %s -> %s\n", r.from, r.to)
+		fmt.Fprintf(out, "                 in %s\n\n", strings.Join(changed, ", "))
+	}
+	return b
+}
+
+// replaceOrigin replaces every occurrence of the origin from (and its
+// JSON-escaped form, http:\/\/...) in s, so long as it isn't the start
+// of some longer host name or a different port.
+func replaceOrigin(s []byte, from, to string) ([]byte, int) {
+	total := 0
+	for _, esc := range []bool{false, true} {
+		f, t := from, to
+		if esc {
+			f, t = strings.Replace(f, "/", `\/`, -1), strings.Replace(t, "/", `\/`, -1)
+		}
+
+		var out bytes.Buffer
+		rest := s
+		for {
+			i := bytes.Index(rest, []byte(f))
+			if i < 0 {
+				break
+			}
+			end := i + len(f)
+			out.Write(rest[:i])
+			if end < len(rest) && isHostChar(rest[end]) {
+				out.Write(rest[i:end])
+			} else {
+				out.WriteString(t)
+				total++
+			}
+			rest = rest[end:]
+		}
+		out.Write(rest)
+		s = out.Bytes()
+	}
+	return s, total
+}
+
+func isHostChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '.' || c == '-' || c == ':'
+}
+
+// cookie drops the Domain attribute of a Set-Cookie header if it would
+// scope the cookie to the upstream, so that the browser keeps it for
+// gotcha's host instead.  It returns the domain it dropped, if any.
+func (r *originRewriter) cookie(cookie string) (string, string) {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		attr := strings.TrimSpace(part)
+		if len(attr) < 7 || !strings.EqualFold(attr[:7], "domain=") {
+			continue
+		}
+		domain := strings.TrimPrefix(strings.ToLower(attr[7:]), ".")
+		if domain == r.fromHost || strings.HasSuffix(r.fromHost, "."+domain) {
+			return strings.Join(append(parts[:i], parts[i+1:]...), ";"), attr[7:]
+		}
+	}
+	return cookie, ""
+}
+
+// isText tells whether a body of the given content type is one that
+// links can be rewritten in, without mangling it.
+func isText(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(t, "text/"),
+		strings.HasSuffix(t, "+json"),
+		strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// body rewrites a text body, decompressing it first (and compressing
+// it again after) if it is gzip- or deflate-encoded.
+func (r *originRewriter) body(h http.Header, body []byte) ([]byte, int, error) {
+	if len(body) == 0 || !isText(h.Get("Content-Type")) {
+		return body, 0, nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	var plain []byte
+	var err error
+	switch encoding {
+	case "", "identity":
+		plain = body
+	case "gzip", "x-gzip":
+		var zr io.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(body)); err == nil {
+			plain, err = ioutil.ReadAll(zr)
+		}
+	case "deflate":
+		var zr io.Reader
+		if zr, err = zlib.NewReader(bytes.NewReader(body)); err == nil {
+			plain, err = ioutil.ReadAll(zr)
+		}
+	default:
+		return body, 0, fmt.Errorf("can't decode Content-Encoding '%s'", encoding)
+	}
+	if err != nil {
+		return body, 0, fmt.Errorf("can't decode %s body: %s", encoding, err)
+	}
+
+	plain, n := replaceOrigin(plain, r.from, r.to)
+	if n == 0 {
+		return body, 0, nil
+	}
+
+	var out bytes.Buffer
+	var zw io.WriteCloser
+	switch encoding {
+	case "", "identity":
+		return plain, n, nil
+	case "gzip", "x-gzip":
+		zw = gzip.NewWriter(&out)
+	case "deflate":
+		zw = zlib.NewWriter(&out)
+	}
+	zw.Write(plain)
+	zw.Close()
+	return out.Bytes(), n, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestReplaceOrigin(t *testing.T) {
+	const from, to = "https://api.example.com", "http://localhost:3128"
+	tests := []struct {
+		name string
+		in   string
+		want string
+		n    int
+	}{
+		{"nothing to replace", "hello, world", "hello, world", 0},
+		{"the origin alone", "https://api.example.com", "http://localhost:3128", 1},
+		{"with a path", `<a href="https://api.example.com/v1/things">`, `<a href="http://localhost:3128/v1/things">`, 1},
+		{"with a query", "https://api.example.com?q=1", "http://localhost:3128?q=1", 1},
+		{"more than once", "https://api.example.com/a https://api.example.com/b", "http://localhost:3128/a http://localhost:3128/b", 2},
+		{"a longer host name", "https://api.example.com.evil.test/", "https://api.example.com.evil.test/", 0},
+		{"a hyphenated host name", "https://api.example.com-staging/", "https://api.example.com-staging/", 0},
+		{"another port", "https://api.example.com:8443/", "https://api.example.com:8443/", 0},
+		{"another scheme", "http://api.example.com/", "http://api.example.com/", 0},
+		{"JSON-escaped", `{"next":"https:\/\/api.example.com\/v1?page=2"}`, `{"next":"http:\/\/localhost:3128\/v1?page=2"}`, 1},
+		{"JSON-escaped, longer host name", `"https:\/\/api.example.com.evil.test\/"`, `"https:\/\/api.example.com.evil.test\/"`, 0},
+		{"both forms", `https://api.example.com/ https:\/\/api.example.com\/`, `http://localhost:3128/ http:\/\/localhost:3128\/`, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, n := replaceOrigin([]byte(test.in), from, to)
+			if string(got) != test.want {
+				t.Errorf("got '%s', not '%s'", got, test.want)
+			}
+			if n != test.n {
+				t.Errorf("replaced %d, not %d", n, test.n)
+			}
+		})
+	}
+}
+
+func TestRewriteCookieDomain(t *testing.T) {
+	upstream, _ := url.Parse("https://api.example.com:8443")
+	r := newOriginRewriter(upstream, false, "localhost:3128")
+
+	tests := []struct {
+		name    string
+		cookie  string
+		want    string
+		dropped string
+	}{
+		{"no domain", "session=abc; Path=/; HttpOnly", "session=abc; Path=/; HttpOnly", ""},
+		{"the upstream host", "session=abc; Domain=api.example.com; Path=/", "session=abc; Path=/", "api.example.com"},
+		{"a parent domain", "session=abc; Domain=example.com", "session=abc", "example.com"},
+		{"a leading dot", "session=abc; Domain=.example.com; Secure", "session=abc; Secure", ".example.com"},
+		{"any case", "session=abc; domain=API.Example.COM", "session=abc", "API.Example.COM"},
+		{"another domain", "session=abc; Domain=other.test", "session=abc; Domain=other.test", ""},
+		{"a suffix that isn't a parent", "session=abc; Domain=ample.com", "session=abc; Domain=ample.com", ""},
+		{"a subdomain of the upstream", "session=abc; Domain=eu.api.example.com", "session=abc; Domain=eu.api.example.com", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, dropped := r.cookie(test.cookie)
+			if got != test.want {
+				t.Errorf("got '%s', not '%s'", got, test.want)
+			}
+			if dropped != test.dropped {
+				t.Errorf("dropped Domain '%s', not '%s'", dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		contentType string
+		text        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"application/atom+xml", true},
+		{"application/javascript", true},
+		{"image/png", false},
+		{"application/octet-stream", false},
+		{"", false},
+		{"not a media type", false},
+	}
+
+	for _, test := range tests {
+		if got := isText(test.contentType); got != test.text {
+			t.Errorf("isText('%s') is %v, not %v", test.contentType, got, test.text)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Cloud Foundry route services sit between the gorouter and an app.
+// The gorouter sends each request for a bound route to the route
+// service, along with the URL the client asked for (which the route
+// service should pass the request on to), and a signature and some
+// metadata that the gorouter checks when the request comes back to it
+// through that URL.  Those two have to go back exactly as they came,
+// which they do, since gotcha passes all request headers through.
+const (
+	cfForwardedURL   = "X-CF-Forwarded-Url"
+	cfProxySignature = "X-CF-Proxy-Signature"
+	cfProxyMetadata  = "X-CF-Proxy-Metadata"
+)
+
+// routeServiceURL works out where the gorouter wants a request sent.
+func routeServiceURL(req *http.Request) (*url.URL, error) {
+	forwarded := req.Header.Get(cfForwardedURL)
+	if forwarded == "" {
+		return nil, fmt.Errorf("no %s header in request for %s", cfForwardedURL, req.URL)
+	}
+	u, err := url.Parse(forwarded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header '%s': %s", cfForwardedURL, forwarded, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s header '%s': not an absolute URL", cfForwardedURL, forwarded)
+	}
+	return u, nil
+}
+
+// dumpRouteService prints where the gorouter asked for a request to
+// go, and whether it came with the headers needed to get there.
+func dumpRouteService(out io.Writer, req *http.Request) {
+	forwarded := req.Header.Get(cfForwardedURL)
+	if forwarded == "" {
+		fmt.Fprintf(out, "@C{route service:}     @Y{not a route service request (no %s header)}\n", cfForwardedURL)
+		return
+	}
+	fmt.Fprintf(out, "@C{route service:}     forwarding to @Y{%s}\n", forwarded)
+	for _, header := range []string{cfProxySignature, cfProxyMetadata} {
+		if req.Header.Get(header) == "" {
+			fmt.Fprintf(out, "                     @R{no %s header; the gorouter will reject the request}\n", header)
+		}
+	}
+	fmt.Fprintf(out, "\n")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	fmt "github.com/jhunt/go-ansi"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certSource is a certificate (chain) and key that live on disk, for
+// the --tls listener to present instead of minting its own.
+type certSource struct {
+	certFile string
+	keyFile  string
+	modified time.Time
+	pair     *tls.Certificate
+}
+
+// certStore holds all of the certificates the --tls listener has been
+// given, picking between them based on the SNI that clients send, and
+// reloading them whenever they change on disk.
+type certStore struct {
+	lock    sync.RWMutex
+	sources []*certSource
+}
+
+func newCertStore(certs, keys []string) (*certStore, error) {
+	if len(keys) > len(certs) {
+		return nil, fmt.Errorf("more --tls-key files (%d) than --tls-cert files (%d)", len(keys), len(certs))
+	}
+
+	s := &certStore{}
+	for i, cert := range certs {
+		src := &certSource{certFile: cert, keyFile: cert}
+		if i < len(keys) && keys[i] != "" {
+			src.keyFile = keys[i]
+		}
+		if err := src.load(); err != nil {
+			return nil, err
+		}
+		s.sources = append(s.sources, src)
+	}
+	return s, nil
+}
+
+func (src *certSource) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, file := range []string{src.certFile, src.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (src *certSource) load() error {
+	modified, err := src.lastModified()
+	if err != nil {
+		return err
+	}
+
+	pair, err := tls.LoadX509KeyPair(src.certFile, src.keyFile)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src.certFile, err)
+	}
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("%s: %s", src.certFile, err)
+	}
+
+	src.pair = &pair
+	src.modified = modified
+	return nil
+}
+
+func (src *certSource) describe() string {
+	leaf := src.pair.Leaf
+	names := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return fmt.Sprintf("%s [%s] (expires %s)", leaf.Subject, strings.Join(names, ", "), leaf.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// Watch checks the certificate and key files every so often, and
+// reloads any that have changed.  If a reload fails (say, because the
+// certificate has been written out but the key hasn't yet), we keep
+// presenting what we had, and try again next time around.
+func (s *certStore) Watch(every time.Duration) {
+	for range time.Tick(every) {
+		for _, src := range s.sources {
+			modified, err := src.lastModified()
+			if err != nil || !modified.After(src.modified) {
+				continue
+			}
+
+			fresh := &certSource{certFile: src.certFile, keyFile: src.keyFile}
+			if err := fresh.load(); err != nil {
+				fmt.Fprintf(os.Stderr, "@Y{failed to reload %s:} %s\n", src.certFile, err)
+				continue
+			}
+
+			s.lock.Lock()
+			src.pair, src.modified = fresh.pair, fresh.modified
+			s.lock.Unlock()
+			fmt.Fprintf(os.Stderr, "reloaded certificate @C{%s}: %s\n", src.certFile, src.describe())
+		}
+	}
+}
+
+// GetCertificate picks the first certificate that is valid for the
+// server name the client asked for (via SNI), or the first one we
+// have, if none of them fit.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, src := range s.sources {
+		if hello.SupportsCertificate(src.pair) == nil {
+			return src.pair, nil
+		}
+	}
+	return s.sources[0].pair, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	fmt "github.com/jhunt/go-ansi"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tlsConstraints narrow down the TLS versions, cipher suites and key
+// exchange groups (curves) that gotcha is willing to negotiate, either
+// with the upstream, or with clients of the --tls listener, so that
+// compatibility problems can be reproduced through it.  Anything left
+// unset is up to crypto/tls.
+type tlsConstraints struct {
+	min     uint16
+	max     uint16
+	ciphers []uint16
+	curves  []tls.CurveID
+}
+
+func parseTLSConstraints(min, max string, ciphers, curves []string) (tlsConstraints, error) {
+	var c tlsConstraints
+	var err error
+
+	if c.min, err = parseTLSVersion(min); err != nil {
+		return c, err
+	}
+	if c.max, err = parseTLSVersion(max); err != nil {
+		return c, err
+	}
+	if c.min != 0 && c.max != 0 && c.min > c.max {
+		return c, fmt.Errorf("minimum TLS version (%s) is higher than the maximum (%s)", tlsVersionName(c.min), tlsVersionName(c.max))
+	}
+
+	for _, name := range splitList(ciphers) {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return c, err
+		}
+		c.ciphers = append(c.ciphers, id)
+	}
+	for _, name := range splitList(curves) {
+		id, err := parseCurve(name)
+		if err != nil {
+			return c, err
+		}
+		c.curves = append(c.curves, id)
+	}
+	return c, nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	v := strings.ToLower(s)
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "tls"), "v")
+	v = strings.TrimSpace(v)
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0", "1", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unrecognized TLS version '%s' (must be one of 1.0, 1.1, 1.2, or 1.3)", s)
+}
+
+// parseCipherSuite looks up a cipher suite by its IANA name (as Go
+// knows it, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), or its number
+// (e.g. 0xc02f).  Insecure suites are allowed; that's rather the point.
+func parseCipherSuite(s string) (uint16, error) {
+	if strings.HasPrefix(strings.ToLower(s), "0x") {
+		if id, err := strconv.ParseUint(s[2:], 16, 16); err == nil {
+			return uint16(id), nil
+		}
+	}
+
+	var names []string
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if strings.EqualFold(suite.Name, s) {
+			return suite.ID, nil
+		}
+		names = append(names, suite.Name)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("unrecognized cipher suite '%s' (must be one of %s)", s, strings.Join(names, ", "))
+}
+
+var curveNames = map[string]tls.CurveID{
+	"p256":      tls.CurveP256,
+	"p-256":     tls.CurveP256,
+	"secp256r1": tls.CurveP256,
+	"p384":      tls.CurveP384,
+	"p-384":     tls.CurveP384,
+	"secp384r1": tls.CurveP384,
+	"p521":      tls.CurveP521,
+	"p-521":     tls.CurveP521,
+	"secp521r1": tls.CurveP521,
+	"x25519":    tls.X25519,
+}
+
+// parseCurve looks up a key exchange group by name, or by its number
+// in the IANA registry, for groups that newer versions of Go support
+// but that we don't have names for.
+func parseCurve(s string) (tls.CurveID, error) {
+	if id, ok := curveNames[strings.ToLower(s)]; ok {
+		return id, nil
+	}
+	if id, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return tls.CurveID(id), nil
+	}
+	return 0, fmt.Errorf("unrecognized curve '%s' (must be one of P256, P384, P521, X25519, or a group number)", s)
+}
+
+// Apply sets the constraints on a tls.Config.  Note that crypto/tls
+// does not allow the TLS 1.3 cipher suites to be chosen; the cipher
+// suites only constrain TLS 1.2 and below.
+//
+// crypto/tls won't go below TLS 1.2 unless told to, so capping the
+// version below that without saying how low to go lets it go as low
+// as it can.
+func (c tlsConstraints) Apply(config *tls.Config) {
+	if c.min != 0 {
+		config.MinVersion = c.min
+	} else if c.max != 0 && c.max < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS10
+	}
+	if c.max != 0 {
+		config.MaxVersion = c.max
+	}
+	if len(c.ciphers) > 0 {
+		config.CipherSuites = c.ciphers
+	}
+	if len(c.curves) > 0 {
+		config.CurvePreferences = c.curves
+	}
+}
+
+// String describes the constraints, for telling the user about them
+// when gotcha starts up; it is empty if there aren't any.
+func (c tlsConstraints) String() string {
+	var l []string
+	if c.min != 0 || c.max != 0 {
+		min, max := "any", "any"
+		if c.min != 0 {
+			min = tlsVersionName(c.min)
+		}
+		if c.max != 0 {
+			max = tlsVersionName(c.max)
+		}
+		l = append(l, fmt.Sprintf("versions %s to %s", min, max))
+	}
+	if len(c.ciphers) > 0 {
+		names := make([]string, len(c.ciphers))
+		for i, id := range c.ciphers {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		l = append(l, "ciphers "+strings.Join(names, ", "))
+	}
+	if len(c.curves) > 0 {
+		names := make([]string, len(c.curves))
+		for i, id := range c.curves {
+			names[i] = id.String()
+		}
+		l = append(l, "curves "+strings.Join(names, ", "))
+	}
+	return strings.Join(l, "; ")
+}
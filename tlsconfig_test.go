@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+		ok   bool
+	}{
+		{"", 0, true},
+		{"1.0", tls.VersionTLS10, true},
+		{"1", tls.VersionTLS10, true},
+		{"1.1", tls.VersionTLS11, true},
+		{"1.2", tls.VersionTLS12, true},
+		{"12", tls.VersionTLS12, true},
+		{"1.3", tls.VersionTLS13, true},
+		{"TLS1.2", tls.VersionTLS12, true},
+		{"tlsv1.3", tls.VersionTLS13, true},
+		{"TLSv1.0", tls.VersionTLS10, true},
+		{" 1.2 ", tls.VersionTLS12, true},
+		{"1.4", 0, false},
+		{"ssl3", 0, false},
+		{"2", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseTLSVersion(test.in)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("parsed '%s' as %#04x, which should have failed", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse '%s': %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("parsed '%s' as %#04x, not %#04x", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseCipherSuite(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint16
+		ok   bool
+	}{
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true},
+		{"tls_ecdhe_rsa_with_aes_128_gcm_sha256", tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true},
+		{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, true},
+		{"TLS_RSA_WITH_3DES_EDE_CBC_SHA", tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA, true},
+		{"TLS_RSA_WITH_RC4_128_SHA", tls.TLS_RSA_WITH_RC4_128_SHA, true},
+		{"0xc02f", 0xc02f, true},
+		{"0XC02F", 0xc02f, true},
+		{"0x000a", 0x000a, true},
+		{"0x10000", 0, false},
+		{"0xzz", 0, false},
+		{"c02f", 0, false},
+		{"AES128-GCM-SHA256", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseCipherSuite(test.in)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("parsed '%s' as %#04x, which should have failed", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse '%s': %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("parsed '%s' as %#04x, not %#04x", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseCurve(t *testing.T) {
+	tests := []struct {
+		in   string
+		want tls.CurveID
+		ok   bool
+	}{
+		{"P256", tls.CurveP256, true},
+		{"p-256", tls.CurveP256, true},
+		{"secp256r1", tls.CurveP256, true},
+		{"P384", tls.CurveP384, true},
+		{"SECP384R1", tls.CurveP384, true},
+		{"P-521", tls.CurveP521, true},
+		{"X25519", tls.X25519, true},
+		{"29", tls.X25519, true},
+		{"0x001d", tls.X25519, true},
+		{"4588", tls.CurveID(4588), true},
+		{"65536", 0, false},
+		{"X448", 0, false},
+		{"curve25519", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseCurve(test.in)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("parsed '%s' as %d, which should have failed", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse '%s': %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("parsed '%s' as %d, not %d", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseTLSConstraints(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max string
+		ok       bool
+	}{
+		{"no constraints", "", "", true},
+		{"a range", "1.0", "1.2", true},
+		{"one version", "1.2", "1.2", true},
+		{"the minimum over the maximum", "1.3", "1.2", false},
+		{"a bad version", "1.2", "1.9", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTLSConstraints(test.min, test.max, nil, nil)
+			if test.ok && err != nil {
+				t.Errorf("failed to parse %s-%s: %s", test.min, test.max, err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("parsed %s-%s, which should have failed", test.min, test.max)
+			}
+		})
+	}
+}
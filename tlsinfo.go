@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("unknown (0x%04x)", v)
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+func dumpCertificate(out io.Writer, i int, cert *x509.Certificate) {
+	fmt.Fprintf(out, "  @M{[%d]} @C{subject:}     %s\n", i, cert.Subject)
+	fmt.Fprintf(out, "      @C{issuer:}      %s\n", cert.Issuer)
+
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses))
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	if len(sans) > 0 {
+		fmt.Fprintf(out, "      @C{sans:}        %s\n", strings.Join(sans, ", "))
+	}
+
+	now := time.Now()
+	validity := fmt.Sprintf("%s - %s", cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+	if now.After(cert.NotAfter) {
+		fmt.Fprintf(out, "      @C{validity:}    @R{%s (expired)}\n", validity)
+	} else if now.Before(cert.NotBefore) {
+		fmt.Fprintf(out, "      @C{validity:}    @R{%s (not yet valid)}\n", validity)
+	} else {
+		fmt.Fprintf(out, "      @C{validity:}    %s\n", validity)
+	}
+	fmt.Fprintf(out, "      @C{key:}         %s, signed with %s\n", keyDescription(cert.PublicKey), cert.SignatureAlgorithm)
+	fmt.Fprintf(out, "      @C{fingerprint:} %s\n", fingerprint(cert))
+}
+
+func dumpTLS(out io.Writer, host string, state *tls.ConnectionState, roots *x509.CertPool, skipVerify bool) {
+	fmt.Fprintf(out, "@C{version:}         @Y{%s}\n", tlsVersionName(state.Version))
+	fmt.Fprintf(out, "@C{cipher suite:}    @Y{%s}\n", tls.CipherSuiteName(state.CipherSuite))
+	if state.ServerName != "" {
+		fmt.Fprintf(out, "@C{server name:}     @Y{%s}\n", state.ServerName)
+	} else {
+		fmt.Fprintf(out, "@C{server name:}     @Y{(none)}\n")
+	}
+	if state.NegotiatedProtocol != "" {
+		fmt.Fprintf(out, "@C{alpn:}            @Y{%s}\n", state.NegotiatedProtocol)
+	} else {
+		fmt.Fprintf(out, "@C{alpn:}            @Y{(none)}\n")
+	}
+	if len(state.OCSPResponse) > 0 {
+		fmt.Fprintf(out, "@C{ocsp staple:}     @Y{present (%d bytes)}\n", len(state.OCSPResponse))
+	} else {
+		fmt.Fprintf(out, "@C{ocsp staple:}     @Y{absent}\n")
+	}
+
+	if skipVerify {
+		if state.ServerName != "" {
+			host = state.ServerName
+		}
+		if err := verifyChain(host, roots, state.PeerCertificates); err != nil {
+			fmt.Fprintf(out, "@C{verification:}    @R{%s} (ignored, per --no-verify)\n", explainTLSError(err))
+		} else {
+			fmt.Fprintf(out, "@C{verification:}    @G{ok}\n")
+		}
+	}
+
+	fmt.Fprintf(out, "@C{peer certificates:}\n")
+	for i, cert := range state.PeerCertificates {
+		dumpCertificate(out, i, cert)
+	}
+}
+
+// verifyChain does what crypto/tls would have done to verify the
+// upstream, had we not been told to skip verification.
+func verifyChain(host string, roots *x509.CertPool, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no certificates presented")
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// explainTLSError turns the certificate verification errors that
+// crypto/tls and crypto/x509 hand back into something a human can
+// act on.  Errors that have nothing to do with verification are
+// returned as-is.
+func explainTLSError(err error) string {
+	var (
+		invalid  x509.CertificateInvalidError
+		hostname x509.HostnameError
+		unknown  x509.UnknownAuthorityError
+	)
+
+	if errors.As(err, &invalid) {
+		switch invalid.Reason {
+		case x509.Expired:
+			now := time.Now()
+			if now.Before(invalid.Cert.NotBefore) {
+				return fmt.Sprintf("certificate for '%s' is not valid until %s", invalid.Cert.Subject, invalid.Cert.NotBefore.UTC().Format(time.RFC3339))
+			}
+			return fmt.Sprintf("certificate for '%s' expired at %s", invalid.Cert.Subject, invalid.Cert.NotAfter.UTC().Format(time.RFC3339))
+		case x509.NotAuthorizedToSign:
+			return fmt.Sprintf("certificate '%s' is not a CA, but was used to sign another certificate", invalid.Cert.Subject)
+		case x509.IncompatibleUsage:
+			return fmt.Sprintf("certificate for '%s' is not valid for server authentication", invalid.Cert.Subject)
+		}
+		return fmt.Sprintf("certificate for '%s' is invalid: %s", invalid.Cert.Subject, invalid.Error())
+	}
+
+	if errors.As(err, &hostname) {
+		sans := append([]string{}, hostname.Certificate.DNSNames...)
+		for _, ip := range hostname.Certificate.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		if len(sans) == 0 {
+			return fmt.Sprintf("hostname mismatch: certificate has no SANs, and is not valid for '%s'", hostname.Host)
+		}
+		return fmt.Sprintf("hostname mismatch: certificate is valid for %s, not '%s'", strings.Join(sans, ", "), hostname.Host)
+	}
+
+	if errors.As(err, &unknown) {
+		if unknown.Cert != nil {
+			return fmt.Sprintf("unknown authority: certificate for '%s' was issued by '%s', which is not trusted", unknown.Cert.Subject, unknown.Cert.Issuer)
+		}
+		return "unknown authority: certificate was signed by an untrusted CA"
+	}
+
+	return err.Error()
+}
+
+// dumpTLSFailure explains why a TLS handshake with the upstream
+// failed, including whatever certificates the upstream presented.
+// If err isn't a verification failure, it returns the empty string.
+func dumpTLSFailure(out io.Writer, err error) string {
+	var verr *tls.CertificateVerificationError
+	if !errors.As(err, &verr) {
+		return ""
+	}
+
+	why := explainTLSError(verr.Err)
+	fmt.Fprintf(out, "@R{upstream certificate verification failed:} %s\n", why)
+	fmt.Fprintf(out, "@C{peer certificates:}\n")
+	for i, cert := range verr.UnverifiedCertificates {
+		dumpCertificate(out, i, cert)
+	}
+	return why
+}
+
+func hostOnly(hostPort string) string {
+	if host, _, err := net.SplitHostPort(hostPort); err == nil {
+		return host
+	}
+	return hostPort
+}
+
+// trustedCAs builds the pool of CAs that upstream certificates are
+// verified against: the system roots, plus any PEM certificates found
+// in the given files, the given directory, and the inline PEM bundle.
+// If nothing extra was asked for, it returns nil, so that crypto/tls
+// uses the system roots on its own.
+func trustedCAs(files []string, dir string, inline string) (*x509.CertPool, error) {
+	if len(files) == 0 && dir == "" && inline == "" {
+		return nil, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", file)
+		}
+	}
+
+	if dir != "" {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			/* skip anything in the directory that isn't a certificate */
+			pool.AppendCertsFromPEM(b)
+		}
+	}
+
+	if inline != "" && !pool.AppendCertsFromPEM([]byte(inline)) {
+		return nil, fmt.Errorf("no PEM certificates found in $GOTCHA_CA_CERTS")
+	}
+
+	return pool, nil
+}
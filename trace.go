@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	fmt "github.com/jhunt/go-ansi"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// exchangeTrace collects the timestamps of each phase of an upstream
+// exchange, via net/http/httptrace.  When redirects are followed, the
+// trace is reset for each hop, so that what gets dumped is the final
+// request / response pair.
+type exchangeTrace struct {
+	lock sync.Mutex
+
+	id uint64
+
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	bodyDone     time.Time
+
+	reused   bool
+	wasIdle  bool
+	idleTime time.Duration
+	uses     int
+	local    string
+	remote   string
+
+	requested string
+	resolved  string
+	instance  string
+
+	host string
+	tls  *tls.ConnectionState
+
+	certRequested bool
+	certPresented *x509.Certificate
+	certProblem   error
+}
+
+type traceKey struct{}
+
+// Context attaches the trace to ctx, both as an httptrace.ClientTrace
+// and in its own right, so that hooks that only get to see a context
+// (like tls.Config.GetClientCertificate) can find it.
+func (t *exchangeTrace) Context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, traceKey{}, t)
+	return httptrace.WithClientTrace(ctx, t.ClientTrace())
+}
+
+func traceFrom(ctx context.Context) *exchangeTrace {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(traceKey{}).(*exchangeTrace)
+	return t
+}
+
+func (t *exchangeTrace) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.reset(hostOnly(hostPort))
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mark(&t.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mark(&t.dnsDone)
+		},
+		ConnectStart: func(network, addr string) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				t.mark(&t.connectDone)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mark(&t.tlsStart)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mark(&t.tlsDone)
+			if err == nil {
+				t.lock.Lock()
+				t.tls = &state
+				t.lock.Unlock()
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.gotConn = time.Now()
+			t.reused = info.Reused
+			t.wasIdle = info.WasIdle
+			t.idleTime = info.IdleTime
+			if info.Conn != nil {
+				t.uses = connectionUses(info.Conn)
+				if tr := tracked(info.Conn); tr != nil {
+					t.requested, t.resolved = tr.requested, tr.resolved
+				}
+				t.local = info.Conn.LocalAddr().String()
+				t.remote = info.Conn.RemoteAddr().String()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mark(&t.wroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+		},
+	}
+}
+
+func (t *exchangeTrace) reset(host string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.start = time.Now()
+	t.dnsStart, t.dnsDone = time.Time{}, time.Time{}
+	t.connectStart, t.connectDone = time.Time{}, time.Time{}
+	t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+	t.gotConn, t.wroteRequest = time.Time{}, time.Time{}
+	t.firstByte, t.bodyDone = time.Time{}, time.Time{}
+	t.reused, t.wasIdle, t.idleTime, t.uses = false, false, 0, 0
+	t.local, t.remote = "", ""
+	t.requested, t.resolved = "", ""
+	t.host, t.tls = host, nil
+	t.certRequested, t.certPresented, t.certProblem = false, nil, nil
+}
+
+// Connection describes the upstream connection, for labelling the TLS
+// secrets of it in the key log.
+func (t *exchangeTrace) Connection() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return fmt.Sprintf("exchange #%d upstream connection %s -> %s (%s)", t.id, t.local, t.remote, t.host)
+}
+
+func (t *exchangeTrace) clientCertRequested(info *tls.CertificateRequestInfo, cert *tls.Certificate) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.certRequested = true
+	if cert != nil {
+		t.certPresented = cert.Leaf
+		t.certProblem = info.SupportsCertificate(cert)
+	}
+}
+
+// Host is the upstream host that this exchange is connecting to (or
+// last connected to, if it followed a redirect).
+func (t *exchangeTrace) Host() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.host
+}
+
+// TLS is the TLS session negotiated with the upstream, if a new TLS
+// connection was made for this exchange.
+func (t *exchangeTrace) TLS() *tls.ConnectionState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tls
+}
+
+// DumpTLS prints the details of the TLS session negotiated with the
+// upstream, if a new TLS connection was made for this exchange.
+func (t *exchangeTrace) DumpTLS(out io.Writer, roots *x509.CertPool, skipVerify bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.tls == nil {
+		return false
+	}
+	dumpTLS(out, t.host, t.tls, roots, skipVerify)
+
+	if !t.certRequested {
+		fmt.Fprintf(out, "@C{client certificate:} not requested by upstream\n")
+	} else if t.certPresented == nil {
+		fmt.Fprintf(out, "@C{client certificate:} @R{requested by upstream, but none configured}\n")
+	} else {
+		fmt.Fprintf(out, "@C{client certificate:} requested by upstream; presented:\n")
+		dumpCertificate(out, 0, t.certPresented)
+		if t.certProblem != nil {
+			fmt.Fprintf(out, "  @R{upstream may not accept it:} %s\n", t.certProblem)
+		}
+	}
+	return true
+}
+
+func (t *exchangeTrace) mark(when *time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	*when = time.Now()
+}
+
+// Body wraps a response body so that the trace can tell when the
+// last byte of it has been received.
+func (t *exchangeTrace) Body(b io.ReadCloser) io.ReadCloser {
+	if b == nil {
+		return nil
+	}
+	return &tracedBody{ReadCloser: b, trace: t}
+}
+
+type tracedBody struct {
+	io.ReadCloser
+	trace *exchangeTrace
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.trace.lock.Lock()
+		if b.trace.bodyDone.IsZero() {
+			b.trace.bodyDone = time.Now()
+		}
+		b.trace.lock.Unlock()
+	}
+	return n, err
+}
+
+func span(a, b time.Time) string {
+	if a.IsZero() || b.IsZero() {
+		return "-"
+	}
+	return fmt.Sprintf("%5.3f ms", float64(b.Sub(a).Nanoseconds())/1000000)
+}
+
+func (t *exchangeTrace) Dump(out io.Writer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	conn := t.remote
+	if t.local != "" {
+		conn = t.local + " -> " + t.remote
+	}
+	if t.instance != "" {
+		fmt.Fprintf(out, "@C{instance:}        %s\n", t.instance)
+	}
+	if t.requested != "" && t.resolved != "" {
+		fmt.Fprintf(out, "@C{requested:}       %s (via %s)\n", t.requested, t.resolved)
+	} else if t.requested != "" {
+		fmt.Fprintf(out, "@C{requested:}       %s\n", t.requested)
+	}
+	if t.reused {
+		if t.wasIdle {
+			fmt.Fprintf(out, "@C{connection:}      @Y{reused} %s (idle for %s)\n", conn, t.idleTime)
+		} else {
+			fmt.Fprintf(out, "@C{connection:}      @Y{reused} %s\n", conn)
+		}
+	} else {
+		fmt.Fprintf(out, "@C{connection:}      @Y{new} %s\n", conn)
+	}
+	if t.uses > 0 {
+		fmt.Fprintf(out, "@C{requests on it:}  %d\n", t.uses)
+	}
+	fmt.Fprintf(out, "@C{dns lookup:}      @G{%s}\n", span(t.dnsStart, t.dnsDone))
+	fmt.Fprintf(out, "@C{tcp connect:}     @G{%s}\n", span(t.connectStart, t.connectDone))
+	fmt.Fprintf(out, "@C{tls handshake:}   @G{%s}\n", span(t.tlsStart, t.tlsDone))
+	fmt.Fprintf(out, "@C{request write:}   @G{%s}\n", span(t.gotConn, t.wroteRequest))
+	fmt.Fprintf(out, "@C{first byte:}      @G{%s}\n", span(t.wroteRequest, t.firstByte))
+	fmt.Fprintf(out, "@C{body transfer:}   @G{%s}\n", span(t.firstByte, t.bodyDone))
+	fmt.Fprintf(out, "@C{total:}           @G{%s}\n", span(t.start, t.bodyDone))
+}
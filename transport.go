@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// transportOptions tune the pool of upstream connections, and how long
+// gotcha is prepared to wait on the upstream at each step.  Zero means
+// no limit, for all of them.
+type transportOptions struct {
+	maxIdle         int
+	maxIdlePerHost  int
+	maxConnsPerHost int
+
+	idleTimeout     time.Duration
+	dialTimeout     time.Duration
+	tlsTimeout      time.Duration
+	responseTimeout time.Duration
+	keepAlive       time.Duration
+
+	disableKeepAlives bool
+
+	resolve   map[string]string
+	dnsServer string
+}
+
+func parseTransportOptions(opt *Opt) (transportOptions, error) {
+	o := transportOptions{
+		maxIdle:           opt.UpstreamMaxIdle,
+		maxIdlePerHost:    opt.UpstreamMaxIdlePerHost,
+		maxConnsPerHost:   opt.UpstreamMaxConns,
+		disableKeepAlives: opt.UpstreamDisableKeepAlives,
+	}
+
+	var err error
+	if o.resolve, err = parseResolve(opt.Resolve); err != nil {
+		return o, err
+	}
+	if o.dnsServer, err = parseDNSServer(opt.DNSServer); err != nil {
+		return o, err
+	}
+
+	err = parseDurations([]durationOption{
+		{"--upstream-idle-timeout", opt.UpstreamIdleTimeout, &o.idleTimeout},
+		{"--upstream-dial-timeout", opt.UpstreamDialTimeout, &o.dialTimeout},
+		{"--upstream-tls-timeout", opt.UpstreamTLSTimeout, &o.tlsTimeout},
+		{"--upstream-response-timeout", opt.UpstreamResponseTimeout, &o.responseTimeout},
+		{"--upstream-keepalive", opt.UpstreamKeepAlive, &o.keepAlive},
+	})
+	return o, err
+}
+
+// newUpstreamTransport builds the one http.Transport that every
+// exchange with the upstream goes through, so that connections (and
+// TLS sessions) get pooled and reused, the way they would be by any
+// other long-lived client.
+//
+// If TLS session secrets are being logged, gotcha does the TLS
+// handshake itself, rather than leaving it to the transport, so that
+// it can label the secrets of each connection with the exchange that
+// opened it.  Connections made through an HTTP proxy are still set up
+// by the transport, and their secrets go unlabelled.
+func newUpstreamTransport(config *tls.Config, keylog *keyLog, o transportOptions) *http.Transport {
+	dialer := newUpstreamDialer(o)
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, dialer, network, addr)
+		},
+		TLSClientConfig:       config,
+		TLSHandshakeTimeout:   o.tlsTimeout,
+		ResponseHeaderTimeout: o.responseTimeout,
+		IdleConnTimeout:       o.idleTimeout,
+		MaxIdleConns:          o.maxIdle,
+		MaxIdleConnsPerHost:   o.maxIdlePerHost,
+		MaxConnsPerHost:       o.maxConnsPerHost,
+		DisableKeepAlives:     o.disableKeepAlives,
+	}
+
+	if keylog != nil {
+		config.KeyLogWriter = keylog.Writer(nil)
+		t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(ctx, dialer, config, keylog, o.tlsTimeout, network, addr)
+		}
+	}
+	return t
+}
+
+// trackedConn counts the requests made over an upstream connection,
+// and remembers what it was asked to connect to, and how that name was
+// resolved, for the exchanges that reuse it.
+type trackedConn struct {
+	net.Conn
+	uses int32
+
+	requested string
+	resolved  string
+}
+
+// dial connects to the upstream (or proxy), noting the addresses on
+// either end of the new connection in the exchange trace, so that it
+// can be picked out of a packet capture.
+func dial(ctx context.Context, dialer *upstreamDialer, network, addr string) (net.Conn, error) {
+	to, how := dialer.lookup(addr)
+	conn, err := dialer.DialContext(ctx, network, to)
+	if err != nil {
+		return nil, err
+	}
+	if t := traceFrom(ctx); t != nil {
+		t.lock.Lock()
+		t.local = conn.LocalAddr().String()
+		t.remote = conn.RemoteAddr().String()
+		t.lock.Unlock()
+	}
+	return &trackedConn{Conn: conn, requested: addr, resolved: how}, nil
+}
+
+// dialTLS connects to the upstream, and does the TLS handshake the way
+// http.Transport would have, including the httptrace callbacks.
+func dialTLS(ctx context.Context, dialer *upstreamDialer, config *tls.Config, keylog *keyLog, timeout time.Duration, network, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, dialer, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := config.Clone()
+	if c.ServerName == "" {
+		c.ServerName = hostOnly(addr)
+	}
+	if t := traceFrom(ctx); t != nil {
+		c.KeyLogWriter = keylog.Writer(t.Connection)
+	}
+
+	ct := httptrace.ContextClientTrace(ctx)
+	if ct != nil && ct.TLSHandshakeStart != nil {
+		ct.TLSHandshakeStart()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tc := tls.Client(conn, c)
+	err = tc.HandshakeContext(ctx)
+	if ct != nil && ct.TLSHandshakeDone != nil {
+		ct.TLSHandshakeDone(tc.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// connectionUses counts another request made over conn, and returns
+// how many there have been, including this one.
+func connectionUses(conn net.Conn) int {
+	if tr := tracked(conn); tr != nil {
+		return int(atomic.AddInt32(&tr.uses, 1))
+	}
+	return 0
+}
+
+func tracked(conn net.Conn) *trackedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tr, _ := conn.(*trackedConn)
+	return tr
+}